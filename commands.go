@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/modfin/bellman/prompt"
+
+	atools "github.com/jtolio/ajent/tools"
+)
+
+// errQuit is returned by a command to end the session.
+var errQuit = errors.New("quit")
+
+// Command is a REPL command, run by entering "/name args" at the prompt.
+// Commands are handled by ajent itself and never sent to the model.
+type Command struct {
+	Name        string
+	Args        string // argument synopsis for /help, e.g. "[count]"
+	Description string
+	Run         func(ctx context.Context, s *Session, args string) error
+}
+
+// RegisterCommand adds cmd to the session, replacing any existing command
+// with the same name.
+func (s *Session) RegisterCommand(cmd Command) {
+	s.commands[cmd.Name] = cmd
+}
+
+// parseCommand splits input into a command name and its arguments. Input
+// that doesn't look like a command (such as a message starting with a file
+// path) returns ok false.
+func parseCommand(input string) (name, args string, ok bool) {
+	input = strings.TrimSpace(input)
+	if !strings.HasPrefix(input, "/") {
+		return "", "", false
+	}
+	name, args, _ = strings.Cut(input[1:], " ")
+	if name == "" || strings.Contains(name, "/") {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(args), true
+}
+
+// runCommand runs the named command. Unknown commands are reported to the
+// user rather than treated as errors.
+func (s *Session) runCommand(ctx context.Context, name, args string) error {
+	cmd, ok := s.commands[name]
+	if !ok {
+		_, err := fmt.Fprintf(s.output, "[unknown command /%s, try /help]\n\n", name)
+		return err
+	}
+	return s.runInterruptible(ctx, func(ctx context.Context) error {
+		return cmd.Run(ctx, s, args)
+	})
+}
+
+// recordEvent appends an event to the session file, if any.
+func (s *Session) recordEvent(event Event) error {
+	if s.serialized == nil {
+		return nil
+	}
+	event.Time = time.Now()
+	return s.serialized.AppendEvent(event)
+}
+
+func builtinCommands() []Command {
+	return []Command{
+		{
+			Name:        "help",
+			Description: "list commands",
+			Run: func(ctx context.Context, s *Session, args string) error {
+				names := make([]string, 0, len(s.commands))
+				for name := range s.commands {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				var sb strings.Builder
+				for _, name := range names {
+					cmd := s.commands[name]
+					usage := "/" + cmd.Name
+					if cmd.Args != "" {
+						usage += " " + cmd.Args
+					}
+					fmt.Fprintf(&sb, "  %-24s %s\n", usage, cmd.Description)
+				}
+				_, err := fmt.Fprintf(s.output, "%s\n", sb.String())
+				return err
+			},
+		},
+		{
+			Name:        "quit",
+			Description: "end the session",
+			Run: func(ctx context.Context, s *Session, args string) error {
+				return errQuit
+			},
+		},
+		{
+			Name:        "model",
+			Args:        "[[provider/]name]",
+			Description: "show or switch the current model, optionally on another provider",
+			Run: func(ctx context.Context, s *Session, args string) error {
+				if args == "" {
+					_, err := fmt.Fprintf(s.output, "[model: %s]\n\n", s.gen.Request.Model)
+					return err
+				}
+				if err := s.SetModel(parseModelArg(args)); err != nil {
+					_, err = fmt.Fprintf(s.output, "[error: %v]\n\n", err)
+					return err
+				}
+				_, err := fmt.Fprintf(s.output, "[switched to %s]\n\n", s.gen.Request.Model)
+				return err
+			},
+		},
+		{
+			Name:        "tools",
+			Description: "list the tools available to the model",
+			Run: func(ctx context.Context, s *Session, args string) error {
+				var sb strings.Builder
+				for _, t := range s.gen.Tools() {
+					fmt.Fprintf(&sb, "  %s: %s\n", t.Name, t.Description)
+				}
+				_, err := fmt.Fprintf(s.output, "%s\n", sb.String())
+				return err
+			},
+		},
+		{
+			Name:        "history",
+			Args:        "[count]",
+			Description: "show the most recent messages (default 20)",
+			Run: func(ctx context.Context, s *Session, args string) error {
+				count := 20
+				if args != "" {
+					var err error
+					if count, err = strconv.Atoi(args); err != nil || count < 1 {
+						_, err := fmt.Fprintf(s.output, "[invalid count %q]\n\n", args)
+						return err
+					}
+				}
+				start := max(0, len(s.history)-count)
+				var sb strings.Builder
+				for i, p := range s.history[start:] {
+					fmt.Fprintf(&sb, "  %4d %s\n", start+i+1, summarizePrompt(p))
+				}
+				_, err := fmt.Fprintf(s.output, "%s\n", sb.String())
+				return err
+			},
+		},
+		{
+			Name:        "undo",
+			Description: "remove the last user message and everything after it from the conversation, reverting any file edits it made",
+			Run: func(ctx context.Context, s *Session, args string) error {
+				removed := lastExchangeLength(s.history)
+				if removed == 0 {
+					_, err := fmt.Fprintf(s.output, "[nothing to undo]\n\n")
+					return err
+				}
+				if err := s.undoEdits(s.history[len(s.history)-removed:]); err != nil {
+					_, err = fmt.Fprintf(s.output, "[error: %v]\n\n", err)
+					return err
+				}
+				undo := &UndoEvent{Removed: removed}
+				if err := s.recordEvent(Event{Type: EventUndo, Undo: undo}); err != nil {
+					return err
+				}
+				s.history = undoHistory(s.history, undo)
+				_, err := fmt.Fprintf(s.output, "[removed %d messages]\n\n", removed)
+				return err
+			},
+		},
+		{
+			Name:        "save-as",
+			Args:        "<path>",
+			Description: "copy the session file to path and continue the session there",
+			Run: func(ctx context.Context, s *Session, args string) error {
+				if args == "" {
+					_, err := fmt.Fprintf(s.output, "[usage: /save-as <path>]\n\n")
+					return err
+				}
+				fs, ok := s.cfg.Serializer.(*FileSerializer)
+				if !ok {
+					_, err := fmt.Fprintf(s.output, "[this session is not backed by a file]\n\n")
+					return err
+				}
+				if err := s.moveSession(fs, args); err != nil {
+					_, err = fmt.Fprintf(s.output, "[error: %v]\n\n", err)
+					return err
+				}
+				_, err := fmt.Fprintf(s.output, "[session: %s]\n\n", args)
+				return err
+			},
+		},
+		{
+			Name:        "compact",
+			Description: "summarize older conversation history to save context",
+			Run: func(ctx context.Context, s *Session, args string) error {
+				return s.tryCompact(ctx)
+			},
+		},
+	}
+}
+
+// summarizePrompt returns a one line description of p for /history.
+func summarizePrompt(p prompt.Prompt) string {
+	const maxLen = 80
+	text := p.Text
+	switch {
+	case p.ToolCall != nil:
+		text = p.ToolCall.Name + " " + string(p.ToolCall.Arguments)
+	case p.ToolResponse != nil:
+		text = p.ToolResponse.Name + ": " + p.ToolResponse.Response
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > maxLen {
+		text = text[:maxLen] + "..."
+	}
+	return fmt.Sprintf("%-9s %s", p.Role, text)
+}
+
+// lastExchangeLength returns how many prompts at the end of history belong
+// to the last exchange: the last user message and everything after it.
+func lastExchangeLength(history []prompt.Prompt) int {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role == prompt.UserRole {
+			return len(history) - i
+		}
+	}
+	return 0
+}
+
+// moveSession copies the session file (and its edit journal, if any) to
+// path and switches the session over to the copies. If anything fails, the
+// copies are removed and the session carries on with the original files.
+func (s *Session) moveSession(fs *FileSerializer, path string) error {
+	moved, err := fs.CopyTo(path)
+	if err != nil {
+		return err
+	}
+	serialized, _, _, _, err := moved.CreateOrOpen(SessionMeta{SystemPrompt: s.cfg.SystemPrompt})
+	if err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	var journal *atools.Journal
+	if s.cfg.Journal != nil {
+		if journal, err = s.cfg.Journal.CopyTo(journalPath(path)); err != nil {
+			_ = serialized.Close()
+			_ = os.Remove(path)
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		_ = serialized.Close()
+		if journal != nil {
+			_ = journal.Close()
+		}
+		return errors.New("session is closed")
+	}
+	if journal != nil {
+		_ = s.cfg.Journal.Close()
+		s.cfg.Journal = journal
+	}
+	_ = s.serialized.Close()
+	s.serialized = serialized
+	s.cfg.Serializer = moved
+	return nil
+}
+
+// undoEdits reverts the file edits made by the first journaled tool call
+// in prompts and everything after it.
+func (s *Session) undoEdits(prompts []prompt.Prompt) error {
+	if s.cfg.Journal == nil {
+		return nil
+	}
+	for _, p := range prompts {
+		if p.ToolCall == nil || !s.cfg.Journal.Has(p.ToolCall.ToolCallID) {
+			continue
+		}
+		restored, err := s.cfg.Journal.Undo(p.ToolCall.ToolCallID)
+		for _, r := range restored {
+			_, _ = fmt.Fprintf(s.output, "[%s]\n", r)
+		}
+		return err
+	}
+	return nil
+}
+
+// undoHistory removes the last u.Removed prompts from history.
+func undoHistory(history []prompt.Prompt, u *UndoEvent) []prompt.Prompt {
+	return history[:len(history)-min(u.Removed, len(history))]
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/tools"
+
+	atools "github.com/jtolio/ajent/tools"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, tc := range []struct {
+		input, name, args string
+		ok                bool
+	}{
+		{input: "/help\n", name: "help", ok: true},
+		{input: "/history 5\n", name: "history", args: "5", ok: true},
+		{input: "  /save-as  /tmp/a b.hjl \n", name: "save-as", args: "/tmp/a b.hjl", ok: true},
+		{input: "/etc/passwd looks odd\n"},
+		{input: "/\n"},
+		{input: "hello /help\n"},
+	} {
+		name, args, ok := parseCommand(tc.input)
+		if name != tc.name || args != tc.args || ok != tc.ok {
+			t.Errorf("parseCommand(%q) = %q, %q, %v; want %q, %q, %v",
+				tc.input, name, args, ok, tc.name, tc.args, tc.ok)
+		}
+	}
+}
+
+func TestSessionRun_Commands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.hjl")
+	client := &fakeGen{turns: [][]*gen.StreamResponse{
+		{textDelta(0, "first answer")},
+		{textDelta(0, "second answer")},
+	}}
+
+	input := "one\ntwo\n/undo\n/bogus\n/ping pong\n/quit\nnever sent\n"
+	var out bytes.Buffer
+	session, err := NewSession(client, "fake-model", strings.NewReader(input), &out,
+		Config{Serializer: NewFileSerializer(path)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pinged string
+	session.RegisterCommand(Command{
+		Name: "ping",
+		Run: func(ctx context.Context, s *Session, args string) error {
+			pinged = args
+			return nil
+		},
+	})
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	_ = session.Close()
+
+	if pinged != "pong" {
+		t.Errorf("expected registered command to run with args %q, got %q", "pong", pinged)
+	}
+	if !strings.Contains(out.String(), "[unknown command /bogus") {
+		t.Errorf("expected unknown command notice, got %q", out.String())
+	}
+	if client.calls != 2 {
+		t.Errorf("expected 2 model requests, got %d", client.calls)
+	}
+
+	expected := []string{"first answer"}
+	check := func(history []prompt.Prompt) {
+		t.Helper()
+		var got []string
+		for _, p := range history {
+			if p.Role == prompt.AssistantRole {
+				got = append(got, p.Text)
+			}
+		}
+		if strings.Join(got, "|") != strings.Join(expected, "|") {
+			t.Errorf("expected assistant messages %q, got %q", expected, got)
+		}
+	}
+	check(session.history)
+
+	// the undo is replayed when the session is reopened.
+	_, history := openTestSession(t, path)
+	check(history)
+}
+
+func TestSessionRun_ModelSwitch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.hjl")
+	first := &fakeGen{turns: [][]*gen.StreamResponse{{textDelta(0, "from first")}}}
+	second := &fakeGen{turns: [][]*gen.StreamResponse{{textDelta(0, "from second")}}}
+
+	session, err := NewSession(first, "model-a", strings.NewReader("one\n/model other/model-b\ntwo\n"), &bytes.Buffer{},
+		Config{
+			Serializer: NewFileSerializer(path),
+			NewClient: func(provider string) (gen.Gen, error) {
+				if provider != "other" {
+					t.Errorf("unexpected provider %q", provider)
+				}
+				return second, nil
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers = append(providers, "other")
+	defer func() { providers = providers[:len(providers)-1] }()
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	_ = session.Close()
+
+	if first.calls != 1 || second.calls != 1 {
+		t.Errorf("expected one request to each client, got %d and %d", first.calls, second.calls)
+	}
+	if len(session.history) != 5 {
+		t.Errorf("expected history to be kept across the switch, got %d prompts", len(session.history))
+	}
+
+	ser, _, _, events, err := NewFileSerializer(path).CreateOrOpen(SessionMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ser.Close()
+	var models []string
+	for _, event := range events {
+		if event.Type == EventModel {
+			models = append(models, event.Model.String())
+		}
+	}
+	if strings.Join(models, " ") != "fake/model-a fake/model-b" {
+		t.Errorf("unexpected recorded models: %q", models)
+	}
+}
+
+func TestSessionRun_UndoRevertsEdits(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.txt")
+	created := filepath.Join(dir, "created.txt")
+	if err := os.WriteFile(existing, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := atools.OpenJournal(filepath.Join(dir, "session.edits.hjl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	args := func(v map[string]string) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	client := &fakeGen{turns: [][]*gen.StreamResponse{
+		{toolDelta(0, "call-1", "find_replace", args(map[string]string{"path": existing, "old_text": "old", "new_text": "new"}))},
+		{toolDelta(0, "call-2", "create_file", args(map[string]string{"path": created, "content": "hi\n"}))},
+		{textDelta(0, "done")},
+	}}
+	session, err := NewSession(client, "fake-model", strings.NewReader("edit\n/undo\n"), &bytes.Buffer{},
+		Config{
+			Serializer: NewFileSerializer(filepath.Join(dir, "session.hjl")),
+			Tools:      []tools.Tool{atools.FindReplaceTool, atools.CreateFileTool},
+			Journal:    journal,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(existing); err != nil || string(data) != "old\n" {
+		t.Errorf("expected existing.txt to be restored, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Errorf("expected created.txt to be removed, got %v", err)
+	}
+	if len(journal.Entries()) != 0 {
+		t.Errorf("expected undone edits to leave the journal, got %+v", journal.Entries())
+	}
+}
+
+func TestSessionRun_UndoWithEmptyCallIDs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte("v1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := atools.OpenJournal(filepath.Join(dir, "session.edits.hjl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	args := func(v map[string]string) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	// some providers leave tool call IDs empty.
+	client := &fakeGen{turns: [][]*gen.StreamResponse{
+		{toolDelta(0, "", "find_replace", args(map[string]string{"path": path, "old_text": "v1", "new_text": "v2"}))},
+		{textDelta(0, "done")},
+		{toolDelta(0, "", "find_replace", args(map[string]string{"path": path, "old_text": "v2", "new_text": "v3"}))},
+		{textDelta(0, "done")},
+	}}
+	session, err := NewSession(client, "fake-model", strings.NewReader("first\nsecond\n/undo\n"), &bytes.Buffer{},
+		Config{
+			Serializer: NewFileSerializer(filepath.Join(dir, "session.hjl")),
+			Tools:      []tools.Tool{atools.FindReplaceTool},
+			Journal:    journal,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(path); err != nil || string(data) != "v2\n" {
+		t.Errorf("expected only the second edit to be undone, got %q, %v", data, err)
+	}
+	if entries := journal.Entries(); len(entries) != 1 || entries[0].CallID == "" {
+		t.Errorf("expected the first edit to stay in the journal under an assigned ID, got %+v", entries)
+	}
+}
+
+func TestSessionRun_SaveAsMovesJournal(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte("v1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldSession, newSession := filepath.Join(dir, "old.hjl"), filepath.Join(dir, "new.hjl")
+	journal, err := atools.OpenJournal(journalPath(oldSession))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args, _ := json.Marshal(map[string]string{"path": path, "old_text": "v1", "new_text": "v2"})
+	client := &fakeGen{turns: [][]*gen.StreamResponse{
+		{toolDelta(0, "call-1", "find_replace", string(args))},
+		{textDelta(0, "done")},
+	}}
+	session, err := NewSession(client, "fake-model", strings.NewReader("/save-as "+newSession+"\nedit\n"), &bytes.Buffer{},
+		Config{
+			Serializer: NewFileSerializer(oldSession),
+			Tools:      []tools.Tool{atools.FindReplaceTool},
+			Journal:    journal,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	_ = session.Close()
+
+	if old, moved := readSessionFile(t, oldSession), readSessionFile(t, newSession); len(moved) <= len(old) {
+		t.Errorf("expected the conversation to carry on in the new session file, got %d prompts in the old one and %d in the new", len(old), len(moved))
+	}
+	for sessionPath, want := range map[string]int{oldSession: 0, newSession: 1} {
+		j, err := atools.OpenJournal(journalPath(sessionPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(j.Entries()); got != want {
+			t.Errorf("%s: expected %d journal entries, got %d", journalPath(sessionPath), want, got)
+		}
+		_ = j.Close()
+	}
+}
+
+func TestSessionRun_SaveAsFailureKeepsSession(t *testing.T) {
+	dir := t.TempDir()
+	oldSession, newSession := filepath.Join(dir, "old.hjl"), filepath.Join(dir, "new.hjl")
+	journal, err := atools.OpenJournal(journalPath(oldSession))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the new session's journal is in the way, so the move fails partway.
+	if err := os.WriteFile(journalPath(newSession), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &fakeGen{turns: [][]*gen.StreamResponse{{textDelta(0, "answer")}}}
+	var out bytes.Buffer
+	session, err := NewSession(client, "fake-model", strings.NewReader("/save-as "+newSession+"\nhello\n"), &out,
+		Config{Serializer: NewFileSerializer(oldSession), Journal: journal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	_ = session.Close()
+
+	if !strings.Contains(out.String(), "[error: ") {
+		t.Errorf("expected an error, got %q", out.String())
+	}
+	if _, err := os.Stat(newSession); !os.IsNotExist(err) {
+		t.Errorf("expected the partial copy to be removed, got %v", err)
+	}
+	history := readSessionFile(t, oldSession)
+	if len(history) == 0 || history[len(history)-1].Text != "answer" {
+		t.Errorf("expected the conversation to carry on in the original session file, got %+v", history)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+)
+
+const (
+	// compactThreshold is the fraction of the context limit the history may
+	// reach before it is automatically compacted.
+	compactThreshold = 0.8
+	// compactKeepFraction is the fraction of the context limit to keep as
+	// recent, verbatim history when compacting.
+	compactKeepFraction = 0.25
+
+	compactInstructions = `The conversation so far is getting too long to fit in the context window. ` +
+		`Write a summary of it that will replace everything above. Do not call any tools. ` +
+		`Include the user's goals and instructions, decisions made, the current state of the work, ` +
+		`relevant file paths, and anything still left to do. Be concise but keep every detail needed ` +
+		`to continue the work without the original conversation.`
+
+	compactSummaryHeader = "[Summary of earlier conversation, compacted to save context]\n"
+)
+
+// estimateTokens gives a rough, provider-independent estimate of how many
+// tokens the given prompts take, assuming about four bytes per token.
+func estimateTokens(prompts ...prompt.Prompt) int {
+	n := 0
+	for _, p := range prompts {
+		n += len(p.Text)
+		if p.ToolCall != nil {
+			n += len(p.ToolCall.Name) + len(p.ToolCall.Arguments)
+		}
+		if p.ToolResponse != nil {
+			n += len(p.ToolResponse.Name) + len(p.ToolResponse.Response)
+		}
+		if p.Payload != nil {
+			n += len(p.Payload.Data) + len(p.Payload.Uri)
+		}
+	}
+	return n / 4
+}
+
+// compactSplit picks how many of the most recent prompts to keep verbatim
+// so that they take at most keepTokens. Tool responses are never separated
+// from the tool calls they answer, and a trailing user message or tool
+// response that the model has yet to see is always kept.
+func compactSplit(history []prompt.Prompt, keepTokens int) (kept int) {
+	if len(history) > 0 {
+		switch history[len(history)-1].Role {
+		case prompt.UserRole:
+			kept = 1
+		case prompt.ToolResponseRole:
+			kept = min(2, len(history))
+		}
+	}
+	tokens := 0
+	for i := len(history) - 1; i > 0; i-- {
+		tokens += estimateTokens(history[i])
+		if tokens > keepTokens {
+			break
+		}
+		if history[i].Role != prompt.ToolResponseRole {
+			kept = max(kept, len(history)-i)
+		}
+	}
+	return kept
+}
+
+// compactHistory replaces all but the most recent prompts of history with a
+// summary.
+func compactHistory(history []prompt.Prompt, c *CompactionEvent) []prompt.Prompt {
+	kept := min(c.Kept, len(history))
+	rv := make([]prompt.Prompt, 0, kept+1)
+	rv = append(rv, prompt.AsUser(compactSummaryHeader+c.Summary))
+	return append(rv, history[len(history)-kept:]...)
+}
+
+// needsCompaction reports whether the history has grown past the
+// configured context limit's compaction threshold.
+func (s *Session) needsCompaction() bool {
+	if s.cfg.ContextLimit <= 0 {
+		return false
+	}
+	used := estimateTokens(s.history...) + estimateTokens(prompt.AsUser(s.cfg.SystemPrompt))
+	return float64(used) > compactThreshold*float64(s.cfg.ContextLimit)
+}
+
+// compact asks the model to summarize older history, replaces it in memory
+// with the summary, and records the compaction in the session file. The
+// session file keeps the full original transcript.
+func (s *Session) compact(ctx context.Context) error {
+	kept := compactSplit(s.history, int(compactKeepFraction*float64(s.cfg.ContextLimit)))
+	older := s.history[:len(s.history)-kept]
+	if len(older) == 0 {
+		_, err := fmt.Fprintf(s.output, "[nothing to compact]\n\n")
+		return err
+	}
+
+	request := append(append([]prompt.Prompt(nil), older...), prompt.AsUser(compactInstructions))
+	resp, err := s.withRetries(ctx, func() (*gen.Response, error) {
+		return s.gen.WithContext(ctx).Prompt(request...)
+	})
+	if err != nil {
+		return fmt.Errorf("compacting history: %w", err)
+	}
+	if err := s.recordUsage(resp); err != nil {
+		return err
+	}
+	summary := strings.TrimSpace(strings.Join(resp.Texts, "\n\n"))
+	if summary == "" {
+		return errors.New("compacting history: model returned no summary")
+	}
+
+	event := Event{
+		Type:       EventCompaction,
+		Time:       time.Now(),
+		Compaction: &CompactionEvent{Summary: summary, Kept: kept},
+	}
+	if s.serialized != nil {
+		if err := s.serialized.AppendEvent(event); err != nil {
+			return err
+		}
+	}
+	before := estimateTokens(s.history...)
+	s.history = compactHistory(s.history, event.Compaction)
+	_, err = fmt.Fprintf(s.output, "[compacted %d messages into a summary, ~%d -> ~%d tokens]\n\n",
+		len(older), before, estimateTokens(s.history...))
+	return err
+}
+
+// tryCompact compacts the history, reporting rather than returning any
+// failure: a session that can't be compacted is still usable until it
+// actually runs out of context.
+func (s *Session) tryCompact(ctx context.Context) error {
+	err := s.compact(ctx)
+	if err == nil || interrupted(ctx) || ctx.Err() != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.output, "[error: %v]\n\n", err)
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+)
+
+func TestCompactSplit_KeepsToolPairsTogether(t *testing.T) {
+	history := []prompt.Prompt{
+		prompt.AsUser(strings.Repeat("a", 400)),
+		prompt.AsToolCall("call-1", "read_file", []byte(`{}`)),
+		prompt.AsToolResponse("call-1", "read_file", strings.Repeat("b", 40)),
+		prompt.AsAssistant(strings.Repeat("c", 40)),
+	}
+	// the budget fits the tool response and the assistant message, but not
+	// the tool call, so only the assistant message may be kept.
+	if kept := compactSplit(history, 21); kept != 1 {
+		t.Errorf("expected 1 kept prompt, got %d", kept)
+	}
+	if kept := compactSplit(history, 30); kept != 3 {
+		t.Errorf("expected 3 kept prompts, got %d", kept)
+	}
+	if kept := compactSplit(history, 0); kept != 0 {
+		t.Errorf("expected 0 kept prompts, got %d", kept)
+	}
+
+	// prompts the model hasn't answered yet are kept regardless of budget.
+	if kept := compactSplit(history[:3], 0); kept != 2 {
+		t.Errorf("expected 2 kept prompts, got %d", kept)
+	}
+	if kept := compactSplit(append(history, prompt.AsUser("next")), 0); kept != 1 {
+		t.Errorf("expected 1 kept prompt, got %d", kept)
+	}
+}
+
+func TestSessionRun_CompactCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.hjl")
+	client := &fakeGen{turns: [][]*gen.StreamResponse{
+		{textDelta(0, "a long answer")},
+		{textDelta(0, "the summary")},
+	}}
+
+	var out bytes.Buffer
+	session, err := NewSession(client, "fake-model", strings.NewReader("hello\n/compact\n"), &out,
+		Config{Serializer: NewFileSerializer(path)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	_ = session.Close()
+
+	if len(session.history) != 1 || session.history[0].Text != compactSummaryHeader+"the summary" {
+		t.Fatalf("unexpected history after compaction: %+v", session.history)
+	}
+	if !strings.Contains(out.String(), "[compacted 3 messages") {
+		t.Errorf("expected compaction notice in output, got %q", out.String())
+	}
+
+	// the full transcript stays in the file, but reopening the session
+	// restores the compacted history.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "a long answer") || !strings.Contains(string(data), `"type":"compaction"`) {
+		t.Errorf("expected full transcript and compaction marker in session file:\n%s", data)
+	}
+	_, history := openTestSession(t, path)
+	if len(history) != 1 || history[0].Text != compactSummaryHeader+"the summary" {
+		t.Errorf("unexpected history after reopen: %+v", history)
+	}
+}
+
+func TestSessionRun_AutoCompaction(t *testing.T) {
+	client := &fakeGen{turns: [][]*gen.StreamResponse{
+		{textDelta(0, "the summary")},
+		{textDelta(0, "an answer")},
+	}}
+
+	input := strings.Repeat("x", 400) + "\n"
+	session, err := NewSession(client, "fake-model", strings.NewReader(input), &bytes.Buffer{},
+		Config{ContextLimit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.history = []prompt.Prompt{prompt.AsUser(strings.Repeat("y", 400))}
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	if client.calls != 2 {
+		t.Fatalf("expected 2 model requests, got %d", client.calls)
+	}
+	if !strings.HasPrefix(session.history[0].Text, compactSummaryHeader) {
+		t.Errorf("expected history to start with the summary, got %+v", session.history[0])
+	}
+	if len(session.history) != 3 || !strings.HasSuffix(session.history[1].Text, input) {
+		t.Fatalf("expected summary, question, and answer, got %+v", session.history)
+	}
+	if session.history[2].Text != "an answer" {
+		t.Errorf("expected the answer last, got %+v", session.history[2])
+	}
+}
@@ -15,13 +15,35 @@ import (
 type Decoder struct {
 	lines *private.UnbufferedLineReader
 	next  *string
+	read  countingReader
 }
 
 // NewDecoder will create a Decoder from r.
 func NewDecoder(r io.Reader) *Decoder {
-	return &Decoder{
-		lines: private.NewUnbufferedLineReader(r, -1),
+	d := &Decoder{read: countingReader{r: r}}
+	d.lines = private.NewUnbufferedLineReader(&d.read, -1)
+	return d
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// InputOffset returns the input stream byte offset just past the last
+// successfully decoded object and its heredoc fields. This is useful for
+// truncating a stream back to its last complete object.
+func (d *Decoder) InputOffset() int64 {
+	if d.next != nil {
+		return d.read.n - int64(len(*d.next))
 	}
+	return d.read.n
 }
 
 func (d *Decoder) readLine() (string, error) {
@@ -64,6 +64,11 @@
 // Note that the above is intended as a way to preserve exact storage regarding
 // trailing newlines.
 //
+// Lines outside of heredocs that start with # are comments and are skipped:
+//
+//	# a comment
+//	{"type": "object"}
+//
 // Encoding with the Go library is straightforward, but which fields are
 // translated to heredoc style definition does require specification. If the
 // specified heredoc fields are missing in the source object, they are skipped.
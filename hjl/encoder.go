@@ -78,6 +78,17 @@ func (e *Encoder) Encode(v any, heredocFields ...string) error {
 	return e.write(intermediate, heredocs)
 }
 
+// Comment writes text to the output stream as one or more comment lines,
+// which decoders skip.
+func (e *Encoder) Comment(text string) error {
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if _, err := fmt.Fprintf(e.w, "# %s\n", line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (e *Encoder) write(obj map[string]any, heredocs map[string]string) error {
 	if err := json.NewEncoder(e.w).Encode(obj); err != nil {
 		return err
@@ -135,6 +135,29 @@ func TestEncodeMultipleObjects(t *testing.T) {
 	}
 }
 
+func TestEncodeComment(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Comment("first\nsecond\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(basicObj{Type: "obj"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "# first\n# second\n" + `{"type":"obj"}` + "\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+
+	var obj basicObj
+	if err := NewDecoder(&buf).Decode(&obj); err != nil {
+		t.Fatal(err)
+	}
+	if obj.Type != "obj" {
+		t.Errorf("got type %q, want %q", obj.Type, "obj")
+	}
+}
+
 // --- Decoder tests ---
 
 func TestDecodeBasicJSON(t *testing.T) {
@@ -367,6 +390,30 @@ unclosed heredoc`
 	}
 }
 
+func TestDecodeInputOffset(t *testing.T) {
+	first := `{"type":"obj"}` + "\n.text = <<END0\nvalue\nEND0\n"
+	second := `{"type":"second"}` + "\n"
+	input := first + second + `{"type":"trunc`
+	dec := NewDecoder(strings.NewReader(input))
+
+	var obj basicObj
+	if err := dec.Decode(&obj); err != nil {
+		t.Fatal(err)
+	}
+	if got := dec.InputOffset(); got != int64(len(first)) {
+		t.Errorf("got offset %d, want %d", got, len(first))
+	}
+	if err := dec.Decode(&obj); err != nil {
+		t.Fatal(err)
+	}
+	if got := dec.InputOffset(); got != int64(len(first+second)) {
+		t.Errorf("got offset %d, want %d", got, len(first+second))
+	}
+	if err := dec.Decode(&obj); err == nil {
+		t.Fatal("expected error for truncated object")
+	}
+}
+
 // --- Round-trip tests ---
 
 func TestRoundTripSimple(t *testing.T) {
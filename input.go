@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// heredocOpener matches a line ending in a heredoc opener such as <<EOF,
+// like the ones used in hjl session files. The delimiter must be upper case
+// and directly follow the <<, so that prose like "what is 1 << n" or
+// "cout << endl" isn't taken as one.
+var heredocOpener = regexp.MustCompile(`(?:^|\s)<<([A-Z_][A-Z0-9_]*)\s*$`)
+
+var errMessageTooLong = errors.New("max message length exceeded")
+
+// readMessage reads a single user message using readLine. A message is
+// normally one line, but a line ending in a backslash continues onto the
+// next line, and a line ending in a heredoc opener like <<EOF continues
+// until a line containing only EOF. maxLength, if positive, bounds the
+// total length of the message. If input ends partway through a multi-line
+// message, what was read so far is returned.
+func readMessage(readLine func() (string, error), maxLength int) (string, error) {
+	var msg strings.Builder
+	add := func(s string) error {
+		msg.WriteString(s)
+		if maxLength > 0 && msg.Len() > maxLength {
+			return errMessageTooLong
+		}
+		return nil
+	}
+
+	heredoc := ""
+	for first := true; ; first = false {
+		line, err := readLine()
+		if err != nil {
+			if !first && errors.Is(err, io.EOF) {
+				return msg.String(), nil
+			}
+			return "", err
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+
+		if heredoc != "" {
+			if trimmed == heredoc {
+				return msg.String(), nil
+			}
+			if err := add(line); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		if strings.HasSuffix(trimmed, `\`) {
+			if err := add(strings.TrimSuffix(trimmed, `\`) + "\n"); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		if m := heredocOpener.FindStringSubmatchIndex(trimmed); m != nil {
+			if prefix := strings.TrimSpace(trimmed[:m[0]]); prefix != "" {
+				if err := add(prefix + "\n"); err != nil {
+					return "", err
+				}
+			}
+			heredoc = trimmed[m[2]:m[3]]
+			continue
+		}
+
+		if err := add(line); err != nil {
+			return "", err
+		}
+		return msg.String(), nil
+	}
+}
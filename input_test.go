@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jtolio/ajent/private"
+)
+
+func readTestMessages(t *testing.T, input string, maxLength int) ([]string, error) {
+	t.Helper()
+	r := private.NewUnbufferedLineReader(strings.NewReader(input), maxLength)
+	var msgs []string
+	for {
+		msg, err := readMessage(r.ReadLine, maxLength)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected []string
+	}{
+		{"one\ntwo\n", []string{"one\n", "two\n"}},
+		{"first \\\nsecond\\\nthird\nnext\n", []string{"first \nsecond\nthird\n", "next\n"}},
+		{"<<EOF\npanic: oops\n\ngoroutine 1\nEOF\nnext\n", []string{"panic: oops\n\ngoroutine 1\n", "next\n"}},
+		{"what is this? <<END\n  trace\nEND\n", []string{"what is this?\n  trace\n"}},
+		{"why does std::cout << endl fail\nnext\n", []string{"why does std::cout << endl fail\n", "next\n"}},
+		{"what is 1 << n\nnext\n", []string{"what is 1 << n\n", "next\n"}},
+		{"shift by << N\nnext\n", []string{"shift by << N\n", "next\n"}},
+		{"x<<EOF\nnext\n", []string{"x<<EOF\n", "next\n"}},
+		{"<<EOF\nunterminated\n", []string{"unterminated\n"}},
+		{"no newline", []string{"no newline"}},
+	} {
+		msgs, err := readTestMessages(t, tc.input, 0)
+		if err == nil || !strings.Contains(err.Error(), "EOF") {
+			t.Errorf("%q: expected EOF, got %v", tc.input, err)
+		}
+		if strings.Join(msgs, "|") != strings.Join(tc.expected, "|") {
+			t.Errorf("%q: expected %q, got %q", tc.input, tc.expected, msgs)
+		}
+	}
+}
+
+func TestReadMessage_TotalLength(t *testing.T) {
+	_, err := readTestMessages(t, "<<EOF\n0123456789\n0123456789\nEOF\n", 16)
+	if !errors.Is(err, errMessageTooLong) {
+		t.Errorf("expected errMessageTooLong, got %v", err)
+	}
+}
@@ -2,16 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"time"
 
-	"github.com/modfin/bellman/models/gen"
-	"github.com/modfin/bellman/services/anthropic"
-	"github.com/modfin/bellman/services/ollama"
-	"github.com/modfin/bellman/services/openai"
-	"github.com/modfin/bellman/services/vertexai"
 	"github.com/modfin/bellman/tools"
 
 	atools "github.com/jtolio/ajent/tools"
@@ -22,19 +20,46 @@ var (
 
 	flagModel = flag.String("model", "claude-haiku-4-5", "the model to use")
 
-	flagURL    = flag.String("url", "", "connection url (depends on provider)")
-	flagAPIKey = flag.String("api-key", "", "your api key (depends on provider)")
+	flagURL    = flag.String("url", "", "connection url for -provider (depends on provider). other providers, such as ones switched to with /model, use OLLAMA_HOST or OPENAI_BASE_URL")
+	flagAPIKey = flag.String("api-key", "", "your api key for -provider (depends on provider). other providers, such as ones switched to with /model, use ANTHROPIC_API_KEY or OPENAI_API_KEY")
 
 	flagProject    = flag.String("project", "", "project (vertexai specific)")
 	flagRegion     = flag.String("region", "", "region (vertexai specific)")
 	flagCredential = flag.String("credential", "", "credential (vertexai specific)")
 
-	flagSystemPrompt = flag.String("system-prompt", "", "path to a system prompt file")
-	flagMaxTokens    = flag.Int("max-tokens", 0, "max tokens")
-	flagBraveAPIKey  = flag.String("brave-api-key", "", "Brave Search API key (enables web_search tool)")
-	flagSearchURL    = flag.String("search-url", "", "Custom search endpoint URL (defaults to Brave Search API)")
+	flagSystemPrompt    = flag.String("system-prompt", "", "path to a system prompt file")
+	flagMaxTokens       = flag.Int("max-tokens", 0, "max tokens")
+	flagBraveAPIKey     = flag.String("brave-api-key", "", "Brave Search API key (enables web_search tool)")
+	flagSearchURL       = flag.String("search-url", "", "Custom search endpoint URL (defaults to Brave Search API)")
+	flagStream          = flag.Bool("stream", false, "stream model output as it is generated. ollama doesn't support streaming, so its output is shown once complete")
+	flagToolWorkers     = flag.Int("tool-workers", 4, "max number of read-only tool calls to run concurrently")
+	flagBashMaxTimeout  = flag.Duration("bash-max-timeout", 10*time.Minute, "the longest timeout the model may ask for on a single bash call")
+	flagBashOutputHead  = flag.Int("bash-output-head", 2048, "bytes of the start of long bash output to show the model")
+	flagBashOutputTail  = flag.Int("bash-output-tail", 6144, "bytes of the end of long bash output to show the model. the full output is saved to a scratch file")
+	flagBashScrubEnv    = flag.String("bash-scrub-env", "*API_KEY*,*APIKEY*,*SECRET*,*TOKEN*,*PASSWORD*,*CREDENTIAL*", "comma-separated glob patterns (case-insensitive) of environment variables to hide from bash commands")
+	flagPersistentShell = flag.Bool("persistent-shell", false, "run bash commands in one shell that lives for the whole session, so cd, exported variables and activated virtualenvs carry over between calls")
+	flagHashWidth       = flag.Int("hash-width", atools.DefaultHashWidth, fmt.Sprintf("hex digits in the line hashes the file tools show (%d-%d). wider hashes make it less likely a stale line reference goes unnoticed, at the cost of more tokens", atools.DefaultHashWidth, atools.MaxHashWidth))
+	flagContextLimit    = flag.Int("context-limit", 0, "the model's context window in tokens. if set, older history is summarized automatically as it approaches the limit (see also /compact)")
 )
 
+// flagBashEnv holds the -bash-env NAME=VALUE settings.
+var flagBashEnv = map[string]string{}
+
+func init() {
+	flag.Func("bash-env", "set NAME=VALUE in the environment of every bash command (may be repeated)", func(s string) error {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("expected NAME=VALUE, got %q", s)
+		}
+		flagBashEnv[name] = value
+		return nil
+	})
+}
+
+// interruptWindow is how soon a second SIGINT must follow the first to exit
+// ajent instead of just interrupting the current turn.
+const interruptWindow = 2 * time.Second
+
 func usage() {
 	_, _ = fmt.Fprintf(os.Stderr, "Usage: %s [flags] [session.hjl]\n", os.Args[0])
 	_, _ = fmt.Fprintf(os.Stderr, "If no session file is provided, one is created in ~/.ajent/sessions/\n")
@@ -42,17 +67,25 @@ func usage() {
 	os.Exit(1)
 }
 
-func buildTools(braveAPIKey, searchURL string) []tools.Tool {
+func buildTools(braveAPIKey, searchURL string, bash atools.BashConfig) []tools.Tool {
 	t := []tools.Tool{
 		atools.WebFetchTool,
 		atools.ReadFileTool,
+		atools.ReadFilesTool,
 		atools.ListDirTool,
 		atools.EditFileTool,
-		atools.BashTool,
+		atools.NewBashTool(bash),
+		atools.NewBashOutputTool(bash),
+		atools.BashStdinTool,
+		atools.NewBashKillTool(bash),
 		atools.CreateFileTool,
 		atools.GrepFileTool,
+		atools.GrepTool,
+		atools.FindFilesTool,
 		atools.TreeTool,
 		atools.FindReplaceTool,
+		atools.ReplaceAllTool,
+		atools.UndoEditTool,
 	}
 	if braveAPIKey != "" {
 		t = append(t, atools.NewWebSearchTool(braveAPIKey, searchURL))
@@ -60,10 +93,36 @@ func buildTools(braveAPIKey, searchURL string) []tools.Tool {
 	return t
 }
 
+// handleInterrupts cancels the session's in-flight model request or tool
+// call on SIGINT. A second SIGINT within interruptWindow, or any SIGINT while
+// the session is waiting for input, exits the process after closing the
+// session, which stops any processes it started, removes its scratch files
+// and closes its files.
+func handleInterrupts(session *Session, sigs <-chan os.Signal) {
+	var last time.Time
+	for range sigs {
+		if time.Since(last) < interruptWindow || !session.Interrupt() {
+			_ = session.Close()
+			os.Exit(130)
+		}
+		last = time.Now()
+		_, _ = fmt.Fprintf(os.Stderr, "\n[interrupting, press Ctrl-C again to exit]\n")
+	}
+}
+
 func main() {
 	flag.Parse()
 	ctx := context.Background()
 
+	if *flagHashWidth < atools.DefaultHashWidth || *flagHashWidth > atools.MaxHashWidth {
+		fmt.Fprintf(os.Stderr, "-hash-width must be between %d and %d\n", atools.DefaultHashWidth, atools.MaxHashWidth)
+		os.Exit(1)
+	}
+	if *flagBashOutputHead < 0 || *flagBashOutputTail < 0 {
+		fmt.Fprintf(os.Stderr, "-bash-output-head and -bash-output-tail can't be negative\n")
+		os.Exit(1)
+	}
+
 	sessionPath := flag.Arg(0)
 	if sessionPath == "" {
 		var err error
@@ -75,36 +134,54 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Session: %s\n", sessionPath)
 	}
 
-	var client gen.Gen
-	switch strings.ToLower(*flagProvider) {
-	case "anthropic":
-		client = anthropic.New(*flagAPIKey)
-	case "ollama":
-		client = ollama.New(*flagURL)
-	case "openai":
-		c := openai.New(*flagAPIKey)
-		if *flagURL != "" {
-			c.SetBaseURL(*flagURL)
+	providerCfg := ProviderConfig{
+		Provider:   *flagProvider,
+		URL:        *flagURL,
+		APIKey:     *flagAPIKey,
+		Project:    *flagProject,
+		Region:     *flagRegion,
+		Credential: *flagCredential,
+	}
+	client, err := providerCfg.NewClient(*flagProvider)
+	if err != nil {
+		if errors.Is(err, errUnknownProvider) {
+			usage()
 		}
-		client = c
-	case "vertexai":
-		var err error
-		client, err = vertexai.New(vertexai.GoogleConfig{
-			Project:    *flagProject,
-			Region:     *flagRegion,
-			Credential: *flagCredential,
-		})
-		if err != nil {
-			panic(err)
+		if errors.Is(err, errNoCredentials) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		panic(err)
+	}
+
+	journal, err := atools.OpenJournal(journalPath(sessionPath))
+	if err != nil {
+		panic(err)
+	}
+
+	bashCfg := atools.BashConfig{
+		MaxTimeout: *flagBashMaxTimeout,
+		OutputHead: *flagBashOutputHead,
+		OutputTail: *flagBashOutputTail,
+		Env:        flagBashEnv,
+	}
+	for _, pattern := range strings.Split(*flagBashScrubEnv, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			bashCfg.ScrubEnv = append(bashCfg.ScrubEnv, pattern)
 		}
-	default:
-		usage()
 	}
 
 	cfg := Config{
-		MaxTokens:  *flagMaxTokens,
-		Tools:      buildTools(*flagBraveAPIKey, *flagSearchURL),
-		Serializer: NewFileSerializer(sessionPath),
+		MaxTokens:       *flagMaxTokens,
+		Tools:           buildTools(*flagBraveAPIKey, *flagSearchURL, bashCfg),
+		Serializer:      NewFileSerializer(sessionPath),
+		Stream:          *flagStream,
+		ToolWorkers:     *flagToolWorkers,
+		ContextLimit:    *flagContextLimit,
+		NewClient:       providerCfg.NewClient,
+		Journal:         journal,
+		PersistentShell: *flagPersistentShell,
+		HashWidth:       *flagHashWidth,
 	}
 
 	if *flagSystemPrompt != "" {
@@ -120,6 +197,11 @@ func main() {
 		panic(err)
 	}
 	defer session.Close()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go handleInterrupts(session, sigs)
+
 	if err := session.Run(ctx); err != nil {
 		panic(err)
 	}
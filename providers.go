@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/services/anthropic"
+	"github.com/modfin/bellman/services/ollama"
+	"github.com/modfin/bellman/services/openai"
+	"github.com/modfin/bellman/services/vertexai"
+)
+
+var (
+	errUnknownProvider = errors.New("unknown provider")
+	errNoCredentials   = errors.New("no credentials configured")
+)
+
+// providers are the provider names NewClient accepts.
+var providers = []string{"anthropic", "ollama", "openai", "vertexai"}
+
+// providerEnv names the standard environment variables each provider's API
+// key and URL are read from, for providers other than the one the -api-key
+// and -url flags were given for.
+var providerEnv = map[string]struct{ apiKey, url string }{
+	"anthropic": {apiKey: "ANTHROPIC_API_KEY"},
+	"ollama":    {url: "OLLAMA_HOST"},
+	"openai":    {apiKey: "OPENAI_API_KEY", url: "OPENAI_BASE_URL"},
+}
+
+// ProviderConfig holds the connection settings used to construct provider
+// clients. Settings that don't apply to a provider are ignored.
+type ProviderConfig struct {
+	// Provider is the provider URL and APIKey belong to. They are never
+	// given to any other provider, which get theirs from providerEnv
+	// instead, so a key can't leak to the wrong service on a /model switch.
+	Provider string
+	URL      string
+	APIKey   string
+
+	// vertexai specific
+	Project    string
+	Region     string
+	Credential string
+}
+
+// credentials returns the API key and URL to use for provider.
+func (c ProviderConfig) credentials(provider string) (apiKey, url string) {
+	env := providerEnv[provider]
+	if provider == strings.ToLower(c.Provider) {
+		apiKey, url = c.APIKey, c.URL
+	}
+	if apiKey == "" && env.apiKey != "" {
+		apiKey = os.Getenv(env.apiKey)
+	}
+	if url == "" && env.url != "" {
+		url = os.Getenv(env.url)
+	}
+	return apiKey, url
+}
+
+// NewClient constructs a client for the named provider. It fails with
+// errNoCredentials if the provider needs an API key or URL and none is
+// configured.
+func (c ProviderConfig) NewClient(provider string) (gen.Gen, error) {
+	provider = strings.ToLower(provider)
+	apiKey, url := c.credentials(provider)
+	switch provider {
+	case "anthropic":
+		if apiKey == "" {
+			return nil, fmt.Errorf("%w for anthropic: use -api-key or set ANTHROPIC_API_KEY", errNoCredentials)
+		}
+		return anthropic.New(apiKey), nil
+	case "ollama":
+		if url == "" {
+			return nil, fmt.Errorf("%w for ollama: use -url or set OLLAMA_HOST", errNoCredentials)
+		}
+		return ollama.New(url), nil
+	case "openai":
+		if apiKey == "" {
+			return nil, fmt.Errorf("%w for openai: use -api-key or set OPENAI_API_KEY", errNoCredentials)
+		}
+		client := openai.New(apiKey)
+		if url != "" {
+			client.SetBaseURL(url)
+		}
+		return client, nil
+	case "vertexai":
+		if c.Project == "" {
+			return nil, fmt.Errorf("%w for vertexai: use -project", errNoCredentials)
+		}
+		return vertexai.New(vertexai.GoogleConfig{
+			Project:    c.Project,
+			Region:     c.Region,
+			Credential: c.Credential,
+		})
+	}
+	return nil, fmt.Errorf("%w %q (expected one of %s)", errUnknownProvider, provider, strings.Join(providers, ", "))
+}
+
+// canStream reports whether bellman can stream responses from the provider
+// with the given client name (as returned by gen.Gen.Provider). Its ollama
+// client doesn't implement streaming.
+func canStream(provider string) bool {
+	return provider != ollama.Provider
+}
+
+// parseModelArg splits a model argument like "openai/gpt-5" into its
+// provider and model name. The provider is empty if the argument doesn't
+// start with a known provider name, since model names may contain slashes
+// themselves.
+func parseModelArg(arg string) (provider, name string) {
+	if prefix, rest, ok := strings.Cut(arg, "/"); ok {
+		for _, p := range providers {
+			if strings.EqualFold(prefix, p) {
+				return p, rest
+			}
+		}
+	}
+	return "", arg
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseModelArg(t *testing.T) {
+	for _, tc := range []struct{ arg, provider, name string }{
+		{"claude-sonnet-4-5", "", "claude-sonnet-4-5"},
+		{"OpenAI/gpt-5", "openai", "gpt-5"},
+		{"accounts/fireworks/models/kimi-k2", "", "accounts/fireworks/models/kimi-k2"},
+		{"openai/accounts/fireworks/models/kimi-k2", "openai", "accounts/fireworks/models/kimi-k2"},
+	} {
+		provider, name := parseModelArg(tc.arg)
+		if provider != tc.provider || name != tc.name {
+			t.Errorf("parseModelArg(%q) = %q, %q; want %q, %q", tc.arg, provider, name, tc.provider, tc.name)
+		}
+	}
+}
+
+func TestNewClient_UnknownProvider(t *testing.T) {
+	if _, err := (ProviderConfig{}).NewClient("nope"); !errors.Is(err, errUnknownProvider) {
+		t.Errorf("expected errUnknownProvider, got %v", err)
+	}
+}
+
+func TestNewClient_CredentialsStayWithTheirProvider(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("OPENAI_BASE_URL", "")
+	cfg := ProviderConfig{Provider: "anthropic", APIKey: "sk-ant-secret", URL: "https://example.com"}
+
+	if _, err := cfg.NewClient("anthropic"); err != nil {
+		t.Errorf("expected the flag key to be used for anthropic, got %v", err)
+	}
+	if _, err := cfg.NewClient("openai"); !errors.Is(err, errNoCredentials) {
+		t.Errorf("expected errNoCredentials switching to openai, got %v", err)
+	}
+	if apiKey, url := cfg.credentials("openai"); apiKey != "" || url != "" {
+		t.Errorf("anthropic's credentials leaked to openai: %q, %q", apiKey, url)
+	}
+
+	t.Setenv("OPENAI_API_KEY", "sk-openai")
+	if apiKey, url := cfg.credentials("openai"); apiKey != "sk-openai" || url != "" {
+		t.Errorf("expected openai's own key, got %q, %q", apiKey, url)
+	}
+	if _, err := cfg.NewClient("openai"); err != nil {
+		t.Errorf("expected a client with OPENAI_API_KEY set, got %v", err)
+	}
+}
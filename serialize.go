@@ -1,24 +1,76 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/jtolio/ajent/hjl"
+	"github.com/modfin/bellman/models/gen"
 	"github.com/modfin/bellman/prompt"
 )
 
+const abortedToolResponse = "error: tool call aborted (ajent exited before the tool call completed)"
+
 type SessionMeta struct {
 	SystemPrompt string `json:"system_prompt"`
 }
 
+// Event is a session file record that isn't itself a prompt, such as a
+// compaction marker. Events are kept alongside prompts so the file remains
+// a faithful log of what happened in the session.
+type Event struct {
+	Type       string           `json:"type"`
+	Time       time.Time        `json:"time"`
+	Compaction *CompactionEvent `json:"compaction,omitempty"`
+	Usage      *UsageEvent      `json:"usage,omitempty"`
+	Model      *gen.Model       `json:"model,omitempty"`
+	Undo       *UndoEvent       `json:"undo,omitempty"`
+}
+
+const (
+	EventCompaction = "compaction"
+	EventUsage      = "usage"
+	// EventModel records a switch to a different model. Prompts after it
+	// were generated by (or sent to) that model.
+	EventModel = "model"
+	EventUndo  = "undo"
+)
+
+// UndoEvent records that the last Removed prompts of the in-memory history
+// were discarded. The prompts remain earlier in the session file.
+type UndoEvent struct {
+	Removed int `json:"removed"`
+}
+
+// CompactionEvent records that all but the most recent Kept prompts of the
+// in-memory history were replaced with Summary. The replaced prompts remain
+// earlier in the session file.
+type CompactionEvent struct {
+	Summary string `json:"summary"`
+	Kept    int    `json:"kept"`
+}
+
+// record is used to decode a session file entry, which is either a prompt
+// or (if Type is set) an Event.
+type record struct {
+	prompt.Prompt
+	Event
+}
+
+// Serializer persists sessions. CreateOrOpen returns the session's effective
+// prompt history along with every event recorded so far, in order.
 type Serializer interface {
-	CreateOrOpen(meta SessionMeta) (SerializedSession, SessionMeta, []prompt.Prompt, error)
+	CreateOrOpen(meta SessionMeta) (SerializedSession, SessionMeta, []prompt.Prompt, []Event, error)
 }
 
 type SerializedSession interface {
 	Append(prompts ...prompt.Prompt) error
+	AppendEvent(event Event) error
 	Close() error
 }
 
@@ -30,62 +82,216 @@ func NewFileSerializer(path string) *FileSerializer {
 	return &FileSerializer{path: path}
 }
 
-func (s *FileSerializer) CreateOrOpen(meta SessionMeta) (SerializedSession, SessionMeta, []prompt.Prompt, error) {
-	fh, err := os.Open(s.path)
+func (s *FileSerializer) CreateOrOpen(meta SessionMeta) (SerializedSession, SessionMeta, []prompt.Prompt, []Event, error) {
+	data, err := os.ReadFile(s.path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return s.create(meta)
 		}
-		return nil, SessionMeta{}, nil, err
+		return nil, SessionMeta{}, nil, nil, err
 	}
-	defer fh.Close()
 
-	d := hjl.NewDecoder(fh)
+	d := hjl.NewDecoder(bytes.NewReader(data))
 
 	var fileMeta SessionMeta
 	if err := d.Decode(&fileMeta); err != nil {
-		return nil, SessionMeta{}, nil, err
+		return nil, SessionMeta{}, nil, nil, err
 	}
+	good := d.InputOffset()
 	var history []prompt.Prompt
+	var events []Event
+	var truncated []byte
 	for {
-		var p prompt.Prompt
-		if err := d.Decode(&p, "tool_call.arguments:base64"); err != nil {
-			if errors.Is(err, io.EOF) {
+		var r record
+		if err := d.Decode(&r, "tool_call.arguments:base64"); err != nil {
+			if err == io.EOF {
 				break
 			}
-			return nil, SessionMeta{}, nil, err
+			// ajent may have been killed partway through writing the last
+			// record. anything else is real corruption.
+			tail := data[good:]
+			if !errors.Is(err, io.EOF) && bytes.Contains(tail, []byte("\n")) {
+				return nil, SessionMeta{}, nil, nil, err
+			}
+			truncated = tail
+			break
+		}
+		if r.Type == "" {
+			history = append(history, r.Prompt)
+		} else {
+			history = replayEvent(history, r.Event)
+			events = append(events, r.Event)
+		}
+		good = d.InputOffset()
+	}
+
+	if truncated != nil {
+		if err := os.Truncate(s.path, good); err != nil {
+			return nil, SessionMeta{}, nil, nil, err
 		}
-		history = append(history, p)
 	}
 
 	// Reopen the file in append mode for future writes.
 	afh, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		return nil, SessionMeta{}, nil, err
+		return nil, SessionMeta{}, nil, nil, err
+	}
+	fs := &fileSession{fh: afh, enc: hjl.NewEncoder(afh)}
+
+	history, err = fs.repair(data, history, truncated)
+	if err != nil {
+		_ = afh.Close()
+		return nil, SessionMeta{}, nil, nil, err
 	}
 
-	return &fileSession{fh: afh, enc: hjl.NewEncoder(afh)}, fileMeta, history, nil
+	return fs, fileMeta, history, events, nil
 }
 
-func (s *FileSerializer) create(meta SessionMeta) (SerializedSession, SessionMeta, []prompt.Prompt, error) {
+// replayEvent applies the effect of a previously recorded event to history.
+func replayEvent(history []prompt.Prompt, event Event) []prompt.Prompt {
+	switch event.Type {
+	case EventCompaction:
+		if event.Compaction != nil {
+			return compactHistory(history, event.Compaction)
+		}
+	case EventUndo:
+		if event.Undo != nil {
+			return undoHistory(history, event.Undo)
+		}
+	}
+	return history
+}
+
+// repair records any fixes needed to make a reopened session's history
+// acceptable to providers. Fixes are appended to the file (as comments or
+// synthetic tool responses) so they are visible to anyone reading it. data
+// is the file content as originally read, used to avoid recording the same
+// comment twice.
+func (s *fileSession) repair(data []byte, history []prompt.Prompt, truncated []byte) ([]prompt.Prompt, error) {
+	comment := func(text string) error {
+		if bytes.Contains(data, []byte("# "+text+"\n")) {
+			return nil
+		}
+		return s.enc.Comment(text)
+	}
+
+	if truncated != nil {
+		if err := s.enc.Comment("repair: removed truncated record:\n" + string(truncated)); err != nil {
+			return nil, err
+		}
+	}
+
+	repaired, aborted, orphaned := repairHistory(history)
+	for _, p := range orphaned {
+		if err := comment(fmt.Sprintf("repair: ignoring tool response %q (%s) with no matching tool call",
+			p.ToolResponse.ToolCallID, p.ToolResponse.Name)); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range aborted {
+		if err := s.enc.Comment(fmt.Sprintf("repair: tool call %q (%s) has no response, recording it as aborted",
+			p.ToolResponse.ToolCallID, p.ToolResponse.Name)); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Append(aborted...); err != nil {
+		return nil, err
+	}
+	return repaired, nil
+}
+
+// repairHistory makes sure every tool call in history is immediately followed
+// by its tool response, as providers require. Tool calls with no response get
+// a synthetic "aborted" response, and are returned in aborted as well so the
+// caller can persist them. Tool responses with no earlier matching call are
+// dropped and returned in orphaned. Calls and responses are matched by ID,
+// in order, so calls without IDs still pair up positionally.
+func repairHistory(history []prompt.Prompt) (repaired, aborted, orphaned []prompt.Prompt) {
+	pending := map[string][]int{}
+	pairs := map[int]int{}
+	paired := map[int]bool{}
+	for i, p := range history {
+		switch {
+		case p.Role == prompt.ToolCallRole && p.ToolCall != nil:
+			pending[p.ToolCall.ToolCallID] = append(pending[p.ToolCall.ToolCallID], i)
+		case p.Role == prompt.ToolResponseRole && p.ToolResponse != nil:
+			id := p.ToolResponse.ToolCallID
+			if calls := pending[id]; len(calls) > 0 {
+				pairs[calls[0]] = i
+				paired[i] = true
+				pending[id] = calls[1:]
+			}
+		}
+	}
+
+	repaired = make([]prompt.Prompt, 0, len(history))
+	for i, p := range history {
+		switch {
+		case p.Role == prompt.ToolCallRole && p.ToolCall != nil:
+			repaired = append(repaired, p)
+			if j, ok := pairs[i]; ok {
+				repaired = append(repaired, history[j])
+				continue
+			}
+			resp := prompt.AsToolResponse(p.ToolCall.ToolCallID, p.ToolCall.Name, abortedToolResponse)
+			repaired = append(repaired, resp)
+			aborted = append(aborted, resp)
+		case p.Role == prompt.ToolResponseRole && p.ToolResponse != nil:
+			if !paired[i] {
+				orphaned = append(orphaned, p)
+			}
+		default:
+			repaired = append(repaired, p)
+		}
+	}
+	return repaired, aborted, orphaned
+}
+
+// CopyTo copies the session file to path, which must not already exist, and
+// returns a FileSerializer for the copy.
+func (s *FileSerializer) CopyTo(path string) (*FileSerializer, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fh.Write(data); err != nil {
+		_ = fh.Close()
+		return nil, err
+	}
+	if err := fh.Close(); err != nil {
+		return nil, err
+	}
+	return NewFileSerializer(path), nil
+}
+
+func (s *FileSerializer) create(meta SessionMeta) (SerializedSession, SessionMeta, []prompt.Prompt, []Event, error) {
 	fh, err := os.Create(s.path)
 	if err != nil {
-		return nil, SessionMeta{}, nil, err
+		return nil, SessionMeta{}, nil, nil, err
 	}
 	enc := hjl.NewEncoder(fh)
 	if err := enc.Encode(meta, "system_prompt"); err != nil {
 		fh.Close()
-		return nil, SessionMeta{}, nil, err
+		return nil, SessionMeta{}, nil, nil, err
 	}
-	return &fileSession{fh: fh, enc: enc}, meta, nil, nil
+	return &fileSession{fh: fh, enc: enc}, meta, nil, nil, nil
 }
 
+// fileSession appends to a session file. Its methods may be called
+// concurrently: Close waits for a record being written to be finished.
 type fileSession struct {
+	mu  sync.Mutex
 	fh  *os.File
 	enc *hjl.Encoder
 }
 
 func (s *fileSession) Append(prompts ...prompt.Prompt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for _, p := range prompts {
 		if err := s.enc.Encode(p, "text", "tool_response.content", "tool_call.arguments:base64"); err != nil {
 			return err
@@ -94,7 +300,18 @@ func (s *fileSession) Append(prompts ...prompt.Prompt) error {
 	return s.fh.Sync()
 }
 
+func (s *fileSession) AppendEvent(event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(event, "compaction.summary"); err != nil {
+		return err
+	}
+	return s.fh.Sync()
+}
+
 func (s *fileSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.fh != nil {
 		return s.fh.Close()
 	}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/prompt"
+)
+
+func openTestSession(t *testing.T, path string) (SerializedSession, []prompt.Prompt) {
+	t.Helper()
+	ser, _, history, _, err := NewFileSerializer(path).CreateOrOpen(SessionMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ser.Close() })
+	return ser, history
+}
+
+func TestFileSerializer_RepairsDanglingToolCall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.hjl")
+	ser, _ := openTestSession(t, path)
+	if err := ser.Append(
+		prompt.AsUser("hi"),
+		prompt.AsToolCall("call-1", "bash", []byte(`{"command":"ls"}`)),
+	); err != nil {
+		t.Fatal(err)
+	}
+	_ = ser.Close()
+
+	_, history := openTestSession(t, path)
+	if len(history) != 3 {
+		t.Fatalf("expected 3 prompts, got %d", len(history))
+	}
+	resp := history[2].ToolResponse
+	if resp == nil || resp.ToolCallID != "call-1" || resp.Response != abortedToolResponse {
+		t.Errorf("expected aborted response for call-1, got %+v", history[2])
+	}
+
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(before), "# repair: tool call") {
+		t.Errorf("expected repair comment in session file:\n%s", before)
+	}
+
+	// reopening again must not need (or record) any further repairs.
+	_, history = openTestSession(t, path)
+	if len(history) != 3 {
+		t.Fatalf("expected 3 prompts after second reopen, got %d", len(history))
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Errorf("second reopen modified the session file:\n%s", after)
+	}
+}
+
+func TestFileSerializer_RepairsTruncatedHeredoc(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.hjl")
+	ser, _ := openTestSession(t, path)
+	if err := ser.Append(prompt.AsUser("hi\n")); err != nil {
+		t.Fatal(err)
+	}
+	_ = ser.Close()
+
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fh.WriteString("{\"role\":\"assistant\"}\n.text = <<END0\nhalf a sent")
+	_ = fh.Close()
+
+	ser, history := openTestSession(t, path)
+	if len(history) != 1 {
+		t.Fatalf("expected 1 prompt, got %d", len(history))
+	}
+	if err := ser.Append(prompt.AsAssistant("a complete answer\n")); err != nil {
+		t.Fatal(err)
+	}
+	_ = ser.Close()
+
+	_, history = openTestSession(t, path)
+	if len(history) != 2 || history[1].Text != "a complete answer\n" {
+		t.Fatalf("unexpected history after repair: %+v", history)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "# half a sent\n") {
+		t.Errorf("expected truncated record to be kept as a comment:\n%s", data)
+	}
+}
+
+func TestRepairHistory(t *testing.T) {
+	history := []prompt.Prompt{
+		prompt.AsUser("hi"),
+		prompt.AsToolResponse("stray", "bash", "orphaned"),
+		prompt.AsToolCall("call-1", "read_file", []byte(`{}`)),
+		prompt.AsToolCall("call-2", "read_file", []byte(`{}`)),
+		prompt.AsToolResponse("call-2", "read_file", "second"),
+		prompt.AsUser("more"),
+		prompt.AsToolResponse("call-1", "read_file", "first, late"),
+	}
+
+	repaired, aborted, orphaned := repairHistory(history)
+	if len(orphaned) != 1 || orphaned[0].ToolResponse.ToolCallID != "stray" {
+		t.Errorf("unexpected orphaned responses: %+v", orphaned)
+	}
+	if len(aborted) != 0 {
+		t.Errorf("unexpected aborted responses: %+v", aborted)
+	}
+
+	var roles []string
+	for _, p := range repaired {
+		id := ""
+		if p.ToolCall != nil {
+			id = p.ToolCall.ToolCallID
+		}
+		if p.ToolResponse != nil {
+			id = p.ToolResponse.ToolCallID
+		}
+		roles = append(roles, string(p.Role)+":"+id)
+	}
+	expected := "user: tool-call:call-1 tool-resp:call-1 tool-call:call-2 tool-resp:call-2 user:"
+	if got := strings.Join(roles, " "); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestFileSerializer_CloseWhileAppending(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.hjl")
+	ser, _ := openTestSession(t, path)
+	text := strings.Repeat("line of text\n", 10000)
+	appended := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			if err := ser.Append(prompt.AsUser(text)); err != nil {
+				return
+			}
+			if i == 0 {
+				close(appended)
+			}
+		}
+	}()
+	<-appended
+	_ = ser.Close()
+	<-done
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), "\n") {
+		t.Error("expected Close to leave no record half written")
+	}
+	_, history := openTestSession(t, path)
+	for _, p := range history {
+		if p.Text != text {
+			t.Fatalf("expected only whole records, got one of %d bytes", len(p.Text))
+		}
+	}
+}
@@ -2,23 +2,55 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jtolio/ajent/private"
 	"github.com/modfin/bellman/models/gen"
 	"github.com/modfin/bellman/prompt"
 	"github.com/modfin/bellman/tools"
+
+	atools "github.com/jtolio/ajent/tools"
 )
 
 const (
 	maxUserLineLength = 32768
+
+	interruptedNote = "interrupted by user"
 )
 
+var errInterrupted = errors.New(interruptedNote)
+
+// readOnlyTools don't modify anything, so several calls to them from the
+// same model response may safely run at the same time.
+var readOnlyTools = map[string]bool{
+	"read_file":      true,
+	"read_files":     true,
+	"grep_file":      true,
+	"grep":           true,
+	"find_files":     true,
+	"tree":           true,
+	"list_directory": true,
+	"web_fetch":      true,
+	"web_search":     true,
+}
+
+// mutatingTools edit files. Their arguments are too long to be worth
+// echoing, but their results (which include a diff) are shown.
+var mutatingTools = map[string]bool{
+	"edit_file":    true,
+	"find_replace": true,
+	"create_file":  true,
+	"undo_edit":    true,
+	"replace_all":  true,
+}
+
 // jsonUnescapeHTML reverses Go's default JSON HTML-safety escaping for
 // display purposes. Go's encoding/json escapes &, <, and > as \u0026,
 // \u003c, and \u003e respectively. These are the only three characters
@@ -34,23 +66,66 @@ type Config struct {
 	SystemPrompt string
 	Serializer   Serializer
 	Tools        []tools.Tool
+	// Stream writes model output as it arrives instead of waiting for the
+	// whole response, for providers that support streaming.
+	Stream bool
+	// ToolWorkers bounds how many read-only tool calls run concurrently.
+	ToolWorkers int
+	// ContextLimit is the model's context window size in tokens. If set,
+	// history is compacted automatically as it approaches this size.
+	ContextLimit int
+	// NewClient constructs a client for a named provider, for switching
+	// providers mid-session. If nil, only the model can be switched.
+	NewClient func(provider string) (gen.Gen, error)
+	// Journal, if set, records file contents before the mutating tools
+	// change them, so /undo and the undo_edit tool can restore them. The
+	// session closes it (or, after /save-as, its copy) when it's closed.
+	Journal *atools.Journal
+	// PersistentShell runs bash commands in one long-lived shell, so the
+	// working directory and environment carry over between calls.
+	PersistentShell bool
+	// HashWidth is how many hex digits wide the line hashes the file tools
+	// show are. Zero means atools.DefaultHashWidth.
+	HashWidth int
 }
 
 type Session struct {
+	// mu guards cancelTurn and closed, and the serialized session and
+	// cfg.Journal whenever they are replaced or closed, since Close may be
+	// called from the interrupt handler while the session is running.
+	mu         sync.Mutex
+	cancelTurn context.CancelCauseFunc
+	closed     bool
+
 	gen        *gen.Generator
 	input      *private.UnbufferedLineReader
 	output     io.Writer
 	cfg        Config
 	history    []prompt.Prompt
 	serialized SerializedSession
+	usage      usageTotals
+	commands   map[string]Command
+	jobs       *atools.Jobs
+	shell      *atools.Shell // nil unless cfg.PersistentShell is set
+	scratch    *atools.Scratch
+	files      *atools.FileTracker
+	closeOnce  sync.Once
+	closeErr   error
+	// lastContext is the most recent context message added to history.
+	lastContext string
+
+	// genOpts are the generator options other than the model, used to
+	// rebuild the generator when switching models.
+	genOpts []gen.Option
+	// recordedModel is the model most recently recorded in the session
+	// file, if any.
+	recordedModel *gen.Model
 }
 
 func NewSession(client gen.Gen, model string,
 	input io.Reader, output io.Writer, cfg Config) (*Session, error) {
 
-	opts := []gen.Option{
-		gen.WithModel(gen.Model{Provider: client.Provider(), Name: model}),
-	}
+	var opts []gen.Option
 	if cfg.MaxTokens != 0 {
 		opts = append(opts, gen.WithMaxTokens(cfg.MaxTokens))
 	}
@@ -60,8 +135,10 @@ func NewSession(client gen.Gen, model string,
 
 	var history []prompt.Prompt
 	var serialized SerializedSession
+	usage := usageTotals{}
+	var recordedModel *gen.Model
 	if cfg.Serializer != nil {
-		s, meta, loaded, err := cfg.Serializer.CreateOrOpen(
+		s, meta, loaded, events, err := cfg.Serializer.CreateOrOpen(
 			SessionMeta{SystemPrompt: cfg.SystemPrompt})
 		if err != nil {
 			return nil, err
@@ -69,35 +146,116 @@ func NewSession(client gen.Gen, model string,
 		serialized = s
 		cfg.SystemPrompt = meta.SystemPrompt
 		history = loaded
+		for _, event := range events {
+			switch {
+			case event.Type == EventUsage && event.Usage != nil:
+				usage.add(*event.Usage)
+			case event.Type == EventModel && event.Model != nil:
+				recordedModel = event.Model
+			}
+		}
 	}
 
 	if cfg.SystemPrompt != "" {
 		opts = append(opts, gen.WithSystem(cfg.SystemPrompt))
 	}
 
-	return &Session{
-		gen:        client.Generator(opts...),
-		input:      private.NewUnbufferedLineReader(input, maxUserLineLength),
-		output:     output,
-		cfg:        cfg,
-		history:    history,
-		serialized: serialized,
-	}, nil
+	session := &Session{
+		gen:           client.Generator(append(opts, gen.WithModel(gen.Model{Provider: client.Provider(), Name: model}))...),
+		genOpts:       opts,
+		recordedModel: recordedModel,
+		input:         private.NewUnbufferedLineReader(input, maxUserLineLength),
+		output:        output,
+		cfg:           cfg,
+		history:       history,
+		serialized:    serialized,
+		usage:         usage,
+		commands:      map[string]Command{},
+		jobs:          atools.NewJobs(),
+		scratch:       atools.NewScratch(),
+		files:         atools.NewFileTracker(),
+	}
+	if cfg.PersistentShell {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		session.shell = atools.NewShell(cwd)
+	}
+	for _, cmd := range builtinCommands() {
+		session.RegisterCommand(cmd)
+	}
+	return session, nil
 }
 
-func (s *Session) Close() error {
-	if s.serialized != nil {
-		return s.serialized.Close()
+// SetModel switches the session to a different model, keeping the
+// conversation history. If provider is empty the current provider is kept.
+// The switch is recorded in the session file so later readers can tell
+// which model produced which messages.
+func (s *Session) SetModel(provider, name string) error {
+	model := gen.Model{Provider: s.gen.Request.Model.Provider, Name: name}
+	g := s.gen
+	if provider != "" {
+		if s.cfg.NewClient == nil {
+			return errors.New("switching providers is not supported in this session")
+		}
+		client, err := s.cfg.NewClient(provider)
+		if err != nil {
+			return err
+		}
+		model.Provider = client.Provider()
+		g = client.Generator(s.genOpts...)
+	}
+	s.gen = g.Model(model)
+	return s.recordModel()
+}
+
+// recordModel records the current model in the session file, unless it is
+// already the most recently recorded one.
+func (s *Session) recordModel() error {
+	model := s.gen.Request.Model
+	if s.recordedModel != nil && s.recordedModel.Provider == model.Provider && s.recordedModel.Name == model.Name {
+		return nil
+	}
+	if err := s.recordEvent(Event{Type: EventModel, Model: &gen.Model{Provider: model.Provider, Name: model.Name}}); err != nil {
+		return err
 	}
+	s.recordedModel = &model
 	return nil
 }
 
+// Close kills the session's background jobs and persistent shell, removes
+// its scratch files, and closes the edit journal and the session file. It
+// may be called more than once, such as by the interrupt handler while the
+// session is still running; a record being written to either file is
+// finished first, and later writes fail.
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		_ = s.jobs.Close()
+		if s.shell != nil {
+			_ = s.shell.Close()
+		}
+		_ = s.scratch.Close()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.closed = true
+		if s.cfg.Journal != nil {
+			_ = s.cfg.Journal.Close()
+		}
+		if s.serialized != nil {
+			s.closeErr = s.serialized.Close()
+		}
+	})
+	return s.closeErr
+}
+
 func (s *Session) getUserInput(ctx context.Context) (string, error) {
 	_, err := fmt.Fprintf(s.output, "> ")
 	if err != nil {
 		return "", err
 	}
-	input, err := s.input.ReadLine()
+	input, err := readMessage(s.input.ReadLine, maxUserLineLength)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
 			_, _ = fmt.Fprint(s.output, "\r")
@@ -113,6 +271,40 @@ func (s *Session) getUserInput(ctx context.Context) (string, error) {
 	return input, nil
 }
 
+// readPrompt reads user input until it gets a message for the model,
+// handling any commands along the way.
+func (s *Session) readPrompt(ctx context.Context) (string, error) {
+	for {
+		input, err := s.getUserInput(ctx)
+		if err != nil {
+			return "", err
+		}
+		name, args, ok := parseCommand(input)
+		if !ok {
+			return input, nil
+		}
+		if err := s.runCommand(ctx, name, args); err != nil {
+			if errors.Is(err, errQuit) {
+				return "", io.EOF
+			}
+			return "", err
+		}
+	}
+}
+
+// runInterruptible runs fn in a context that Interrupt can cancel. Being
+// interrupted is not an error.
+func (s *Session) runInterruptible(ctx context.Context, fn func(context.Context) error) error {
+	ctx, endTurn := s.startTurn(ctx)
+	defer endTurn()
+	err := fn(ctx)
+	if interrupted(ctx) {
+		_, _ = fmt.Fprintf(s.output, "\n[%s]\n\n", interruptedNote)
+		return nil
+	}
+	return err
+}
+
 func (s *Session) addTimestamp(result string) string {
 	return time.Now().Format("[2006-01-02 15:04:05 MST]\n") + result
 }
@@ -128,7 +320,25 @@ func (s *Session) callTool(ctx context.Context, call tools.Call) (rv string) {
 	if call.Ref == nil {
 		return fmt.Sprintf("error: unknown tool %q", call.Name)
 	}
+	if interrupted(ctx) {
+		return "error: " + interruptedNote + " before this tool call ran"
+	}
+	ctx = atools.WithJobs(ctx, s.jobs)
+	ctx = atools.WithScratch(ctx, s.scratch)
+	ctx = atools.WithFileTracker(ctx, s.files)
+	if s.shell != nil {
+		ctx = atools.WithShell(ctx, s.shell)
+	}
+	if s.cfg.Journal != nil {
+		ctx = atools.WithJournal(ctx, s.cfg.Journal)
+	}
+	if s.cfg.HashWidth > 0 {
+		ctx = atools.WithHashWidth(ctx, s.cfg.HashWidth)
+	}
 	result, err := call.Ref.Function(ctx, call)
+	if interrupted(ctx) {
+		return "error: " + interruptedNote + "\n" + result
+	}
 	if err != nil {
 		return fmt.Sprintf("error: %v", err)
 	}
@@ -140,104 +350,296 @@ func (s *Session) buildContextMessage() string {
 	if err != nil {
 		cwd = "(unknown)"
 	}
-	return fmt.Sprintf("Working directory: %s\n", cwd)
+	msg := fmt.Sprintf("Working directory: %s\n", cwd)
+	if s.shell != nil && s.shell.Dir() != cwd {
+		msg += fmt.Sprintf("Shell working directory: %s (bash commands run here; other tools resolve relative paths from the working directory)\n", s.shell.Dir())
+	}
+	return msg
 }
 
-func (s *Session) Run(ctx context.Context) error {
-	addToHistory := func(p ...prompt.Prompt) error {
-		s.history = append(s.history, p...)
-		if s.serialized != nil {
-			return s.serialized.Append(p...)
-		}
+// addContextMessage adds the execution context to history if it has
+// changed since it was last added.
+func (s *Session) addContextMessage() error {
+	msg := s.buildContextMessage()
+	if msg == s.lastContext {
 		return nil
 	}
+	s.lastContext = msg
+	return s.addToHistory(prompt.AsUser(msg))
+}
 
-	// Inject execution context at the start of every run
-	if err := addToHistory(prompt.AsUser(s.buildContextMessage())); err != nil {
-		return err
+// streaming reports whether model output is written as it arrives: if
+// streaming was asked for and the current provider supports it.
+func (s *Session) streaming() bool {
+	return s.cfg.Stream && canStream(s.gen.Request.Model.Provider)
+}
+
+// prompt sends the current history to the model. In streaming mode, text
+// and thinking deltas are written to output as they arrive; either way,
+// nothing is added to history until the full response is available.
+func (s *Session) prompt(ctx context.Context) (*gen.Response, error) {
+	g := s.gen.WithContext(ctx)
+	if !s.streaming() {
+		return g.Prompt(s.history...)
+	}
+	stream, err := g.Stream(s.history...)
+	if err != nil {
+		return nil, err
 	}
+	return readStream(stream, s.output)
+}
 
-	for firstLoop := true; true; firstLoop = false {
-		if !firstLoop {
-			var resp *gen.Response
-			var err error
-			for retry := 0; retry < 8; retry++ {
-				resp, err = s.gen.WithContext(ctx).Prompt(s.history...)
-				if err == nil {
-					break
-				}
-				if strings.Contains(err.Error(), "429") || strings.Contains(err.Error(), "503") {
-					backoff := time.Duration(1<<retry) * time.Second
-					_, _ = fmt.Fprintf(s.output, "[Rate limited/Overloaded, retrying in %v...]\n", backoff)
-					select {
-					case <-ctx.Done():
-						return ctx.Err()
-					case <-time.After(backoff):
-					}
-					continue
-				}
-				break
-			}
+// generate calls prompt, retrying when the provider is rate limited or
+// overloaded.
+func (s *Session) generate(ctx context.Context) (*gen.Response, error) {
+	return s.withRetries(ctx, func() (*gen.Response, error) {
+		return s.prompt(ctx)
+	})
+}
 
-			if err != nil {
-				return err
+// withRetries calls fn, retrying with exponential backoff when the provider
+// is rate limited or overloaded.
+func (s *Session) withRetries(ctx context.Context, fn func() (*gen.Response, error)) (resp *gen.Response, err error) {
+	for retry := 0; retry < 8; retry++ {
+		resp, err = fn()
+		if err == nil {
+			return resp, nil
+		}
+		if strings.Contains(err.Error(), "429") || strings.Contains(err.Error(), "503") {
+			backoff := time.Duration(1<<retry) * time.Second
+			_, _ = fmt.Fprintf(s.output, "[Rate limited/Overloaded, retrying in %v...]\n", backoff)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
 			}
+			continue
+		}
+		break
+	}
+	return nil, err
+}
 
-			for _, thought := range resp.Thinking {
-				formatted := fmt.Sprintf("<thought>\n%s\n</thought>", thought)
-				if _, err := fmt.Fprintf(s.output, "%s\n\n", formatted); err != nil {
-					return err
-				}
-				if err := addToHistory(prompt.AsAssistant(formatted)); err != nil {
-					return err
-				}
+// recordUsage adds a model response's token usage to the session totals,
+// records it in the session file, and prints the running totals.
+func (s *Session) recordUsage(resp *gen.Response) error {
+	u := usageFromMetadata(s.gen.Request.Model, resp.Metadata)
+	s.usage.add(u)
+	if s.serialized != nil {
+		if err := s.serialized.AppendEvent(Event{Type: EventUsage, Time: time.Now(), Usage: &u}); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(s.output, "[tokens: %d in, %d out; %s]\n\n",
+		u.InputTokens, u.OutputTokens+u.ThinkingTokens, s.usage)
+	return err
+}
+
+func (s *Session) addToHistory(p ...prompt.Prompt) error {
+	s.history = append(s.history, p...)
+	if s.serialized != nil {
+		return s.serialized.Append(p...)
+	}
+	return nil
+}
+
+// startTurn derives a context for one model request and its tool calls
+// that Interrupt can cancel. The returned function must be called when the
+// turn is over.
+func (s *Session) startTurn(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	s.mu.Lock()
+	s.cancelTurn = cancel
+	s.mu.Unlock()
+	return ctx, func() {
+		s.mu.Lock()
+		s.cancelTurn = nil
+		s.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// Interrupt cancels the in-flight model request or tool call, if any. It
+// returns false if the session is not currently running a turn (e.g. it is
+// waiting for user input).
+func (s *Session) Interrupt() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancelTurn == nil {
+		return false
+	}
+	s.cancelTurn(errInterrupted)
+	return true
+}
+
+func interrupted(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errInterrupted)
+}
+
+// turn runs a single model request and any tool calls it makes. It returns
+// true if the model should be prompted again (because tools were called).
+func (s *Session) turn(ctx context.Context) (more bool, err error) {
+	ctx, endTurn := s.startTurn(ctx)
+	defer endTurn()
+
+	if s.needsCompaction() {
+		if err := s.tryCompact(ctx); err != nil && !interrupted(ctx) {
+			return false, err
+		}
+	}
+
+	resp, err := s.generate(ctx)
+	if interrupted(ctx) {
+		_, _ = fmt.Fprintf(s.output, "\n[%s]\n\n", interruptedNote)
+		return false, s.addToHistory(prompt.AsAssistant("[" + interruptedNote + "]"))
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.recordUsage(resp); err != nil {
+		return false, err
+	}
+	assignCallIDs(resp.Tools)
+
+	for _, thought := range resp.Thinking {
+		formatted := fmt.Sprintf("<thought>\n%s\n</thought>", thought)
+		if !s.streaming() {
+			if _, err := fmt.Fprintf(s.output, "%s\n\n", formatted); err != nil {
+				return false, err
 			}
+		}
+		if err := s.addToHistory(prompt.AsAssistant(formatted)); err != nil {
+			return false, err
+		}
+	}
 
-			for _, text := range resp.Texts {
-				if _, err := fmt.Fprintf(s.output, "%s\n\n", text); err != nil {
-					return err
-				}
-				if err := addToHistory(prompt.AsAssistant(text)); err != nil {
-					return err
-				}
+	for _, text := range resp.Texts {
+		if !s.streaming() {
+			if _, err := fmt.Fprintf(s.output, "%s\n\n", text); err != nil {
+				return false, err
 			}
+		}
+		if err := s.addToHistory(prompt.AsAssistant(text)); err != nil {
+			return false, err
+		}
+	}
 
-			for _, call := range resp.Tools {
-				if call.Name == "edit_file" || call.Name == "find_replace" || call.Name == "create_file" {
-					_, err = fmt.Fprintf(s.output, "[%s]\n", call.Name)
-				} else {
-					_, err = fmt.Fprintf(s.output, "[%s %s]\n", call.Name, jsonUnescapeHTML.Replace(string(call.Argument)))
-				}
-				if err != nil {
-					return err
-				}
-				if err := addToHistory(
-					prompt.Prompt{Role: prompt.ToolCallRole, ToolCall: &prompt.ToolCall{ToolCallID: call.ID, Name: call.Name, Arguments: call.Argument, ThoughtSignature: call.ThoughtSignature}},
-					prompt.AsToolResponse(call.ID, call.Name, func() string {
-						res := s.callTool(ctx, call)
-						if call.Name == "edit_file" || call.Name == "find_replace" || call.Name == "create_file" {
-							_, _ = fmt.Fprintf(s.output, "%s\n", res)
-						}
-						return res
-					}()),
-				); err != nil {
-					return err
-				}
+	// Runs of consecutive read-only tool calls execute concurrently; any
+	// other tool call runs on its own. Results are always recorded in the
+	// order the model made the calls.
+	for start := 0; start < len(resp.Tools); {
+		end := start + 1
+		if readOnlyTools[resp.Tools[start].Name] {
+			for end < len(resp.Tools) && readOnlyTools[resp.Tools[end].Name] {
+				end++
 			}
+		}
+		if err := s.runTools(ctx, resp.Tools[start:end]); err != nil {
+			return false, err
+		}
+		start = end
+	}
 
-			if len(resp.Tools) > 0 {
+	if interrupted(ctx) {
+		_, _ = fmt.Fprintf(s.output, "\n[%s]\n\n", interruptedNote)
+		return false, nil
+	}
+	return len(resp.Tools) > 0, nil
+}
+
+// assignCallIDs gives each call the provider left without an ID (ollama's
+// and vertexai's non-streaming clients do) a unique one, since the undo
+// journal and /undo tell calls apart by ID.
+func assignCallIDs(calls []tools.Call) {
+	for i := range calls {
+		if calls[i].ID == "" {
+			calls[i].ID = "call_" + rand.Text()
+		}
+	}
+}
+
+// runTools executes calls concurrently, bounded by the configured number of
+// tool workers, and then adds each call and its response to history in
+// order.
+func (s *Session) runTools(ctx context.Context, calls []tools.Call) error {
+	for _, call := range calls {
+		var err error
+		if mutatingTools[call.Name] {
+			_, err = fmt.Fprintf(s.output, "[%s]\n", call.Name)
+		} else {
+			_, err = fmt.Fprintf(s.output, "[%s %s]\n", call.Name, jsonUnescapeHTML.Replace(string(call.Argument)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	workers := s.cfg.ToolWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	results := make([]string, len(calls))
+	var wg sync.WaitGroup
+	for i, call := range calls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = s.callTool(ctx, call)
+		}()
+	}
+	wg.Wait()
+
+	for i, call := range calls {
+		if mutatingTools[call.Name] {
+			_, _ = fmt.Fprintf(s.output, "%s\n", results[i])
+		}
+		if err := s.addToHistory(
+			prompt.Prompt{Role: prompt.ToolCallRole, ToolCall: &prompt.ToolCall{ToolCallID: call.ID, Name: call.Name, Arguments: call.Argument, ThoughtSignature: call.ThoughtSignature}},
+			prompt.AsToolResponse(call.ID, call.Name, results[i]),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) Run(ctx context.Context) error {
+	if err := s.recordModel(); err != nil {
+		return err
+	}
+
+	// Inject execution context at the start of every run, and again
+	// whenever it changes.
+	if err := s.addContextMessage(); err != nil {
+		return err
+	}
+
+	for firstLoop := true; true; firstLoop = false {
+		if !firstLoop {
+			more, err := s.turn(ctx)
+			if err != nil {
+				return err
+			}
+			if more {
 				continue
 			}
 		}
 
-		input, err := s.getUserInput(ctx)
+		input, err := s.readPrompt(ctx)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				return nil
 			}
 			return err
 		}
-		if err := addToHistory(prompt.AsUser(s.addTimestamp(input))); err != nil {
+		if err := s.addContextMessage(); err != nil {
+			return err
+		}
+		if err := s.addToHistory(prompt.AsUser(s.addTimestamp(input))); err != nil {
 			return err
 		}
 	}
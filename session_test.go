@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jtolio/ajent/hjl"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/services/ollama"
+	"github.com/modfin/bellman/tools"
+
+	atools "github.com/jtolio/ajent/tools"
+)
+
+// fakeGen is a gen.Gen whose Prompter replays canned responses, one per
+// model turn.
+type fakeGen struct {
+	turns [][]*gen.StreamResponse
+	calls int
+	// provider is the name Provider returns, "fake" by default.
+	provider string
+}
+
+func (f *fakeGen) Provider() string {
+	if f.provider != "" {
+		return f.provider
+	}
+	return "fake"
+}
+
+func (f *fakeGen) Generator(options ...gen.Option) *gen.Generator {
+	g := &gen.Generator{Prompter: &fakePrompter{f: f}}
+	for _, opt := range options {
+		g = opt(g)
+	}
+	return g
+}
+
+type fakePrompter struct {
+	f   *fakeGen
+	req gen.Request
+}
+
+func (p *fakePrompter) SetRequest(req gen.Request) { p.req = req }
+
+// next returns the chunks for the next turn, with tool call references
+// resolved against the request's tools like a real provider would.
+func (p *fakePrompter) next() ([]*gen.StreamResponse, error) {
+	if p.f.calls >= len(p.f.turns) {
+		return nil, errors.New("fake: no more turns")
+	}
+	turn := p.f.turns[p.f.calls]
+	p.f.calls++
+	rv := make([]*gen.StreamResponse, 0, len(turn))
+	for _, chunk := range turn {
+		cp := *chunk
+		if cp.ToolCall != nil {
+			call := *cp.ToolCall
+			for i := range p.req.Tools {
+				if p.req.Tools[i].Name == call.Name {
+					call.Ref = &p.req.Tools[i]
+				}
+			}
+			cp.ToolCall = &call
+		}
+		rv = append(rv, &cp)
+	}
+	return rv, nil
+}
+
+func (p *fakePrompter) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
+	turn, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	stream := make(chan *gen.StreamResponse, len(turn)+1)
+	for _, chunk := range turn {
+		stream <- chunk
+	}
+	stream <- &gen.StreamResponse{Type: gen.TYPE_EOF}
+	close(stream)
+	return readStream(stream, &bytes.Buffer{})
+}
+
+func (p *fakePrompter) Stream(prompts ...prompt.Prompt) (<-chan *gen.StreamResponse, error) {
+	if !canStream(p.f.Provider()) {
+		return nil, errors.New("fake: streaming not supported")
+	}
+	turn, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	stream := make(chan *gen.StreamResponse)
+	go func() {
+		defer close(stream)
+		for _, chunk := range turn {
+			stream <- chunk
+		}
+		stream <- &gen.StreamResponse{Type: gen.TYPE_EOF}
+	}()
+	return stream, nil
+}
+
+func textDelta(index int, content string) *gen.StreamResponse {
+	return &gen.StreamResponse{Type: gen.TYPE_DELTA, Role: prompt.AssistantRole, Index: index, Content: content}
+}
+
+func thinkingDelta(index int, content string) *gen.StreamResponse {
+	return &gen.StreamResponse{Type: gen.TYPE_THINKING_DELTA, Role: prompt.AssistantRole, Index: index, Content: content}
+}
+
+func toolDelta(index int, id, name, args string) *gen.StreamResponse {
+	return &gen.StreamResponse{Type: gen.TYPE_DELTA, Role: prompt.ToolCallRole, Index: index,
+		ToolCall: &tools.Call{ID: id, Name: name, Argument: []byte(args)}}
+}
+
+// readSessionFile returns all prompts in a session file, ignoring events.
+func readSessionFile(t *testing.T, path string) []prompt.Prompt {
+	t.Helper()
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	d := hjl.NewDecoder(fh)
+	var meta SessionMeta
+	if err := d.Decode(&meta); err != nil {
+		t.Fatal(err)
+	}
+	var rv []prompt.Prompt
+	for {
+		var r record
+		if err := d.Decode(&r, "tool_call.arguments:base64"); err != nil {
+			break
+		}
+		if r.Type == "" {
+			rv = append(rv, r.Prompt)
+		}
+	}
+	return rv
+}
+
+func TestReadStream_Assembles(t *testing.T) {
+	stream := make(chan *gen.StreamResponse, 16)
+	for _, chunk := range []*gen.StreamResponse{
+		thinkingDelta(0, "let me "),
+		thinkingDelta(0, "think"),
+		textDelta(1, "hello, "),
+		textDelta(1, "world"),
+		toolDelta(2, "call-1", "read_file", `{"path":`),
+		toolDelta(2, "call-1", "read_file", `"a.go"}`),
+		{Type: gen.TYPE_EOF},
+	} {
+		stream <- chunk
+	}
+	close(stream)
+
+	var out bytes.Buffer
+	resp, err := readStream(stream, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Thinking) != 1 || resp.Thinking[0] != "let me think" {
+		t.Errorf("unexpected thinking: %q", resp.Thinking)
+	}
+	if len(resp.Texts) != 1 || resp.Texts[0] != "hello, world" {
+		t.Errorf("unexpected texts: %q", resp.Texts)
+	}
+	if len(resp.Tools) != 1 || string(resp.Tools[0].Argument) != `{"path":"a.go"}` {
+		t.Errorf("unexpected tools: %+v", resp.Tools)
+	}
+	expected := "<thought>\nlet me think\n</thought>\n\nhello, world\n\n"
+	if out.String() != expected {
+		t.Errorf("expected output %q, got %q", expected, out.String())
+	}
+}
+
+func TestReadStream_Error(t *testing.T) {
+	stream := make(chan *gen.StreamResponse, 4)
+	stream <- textDelta(0, "partial")
+	stream <- &gen.StreamResponse{Type: gen.TYPE_ERROR, Content: "boom"}
+	stream <- &gen.StreamResponse{Type: gen.TYPE_EOF}
+	close(stream)
+
+	_, err := readStream(stream, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("expected stream error, got %v", err)
+	}
+}
+
+func TestSessionRun_Streaming(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.hjl")
+	client := &fakeGen{turns: [][]*gen.StreamResponse{
+		{textDelta(0, "first "), textDelta(0, "answer")},
+	}}
+
+	var out bytes.Buffer
+	session, err := NewSession(client, "fake-model", strings.NewReader("hi\n"), &out,
+		Config{Serializer: NewFileSerializer(path), Stream: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Count(out.String(), "first answer") != 1 {
+		t.Errorf("expected streamed text exactly once in output, got %q", out.String())
+	}
+
+	history := readSessionFile(t, path)
+	if len(history) != 3 {
+		t.Fatalf("expected 3 prompts in session file, got %d", len(history))
+	}
+	if history[2].Role != prompt.AssistantRole || history[2].Text != "first answer" {
+		t.Errorf("unexpected assistant prompt: %+v", history[2])
+	}
+}
+
+func TestSessionRun_StreamingFallsBackForOllama(t *testing.T) {
+	client := &fakeGen{provider: ollama.Provider, turns: [][]*gen.StreamResponse{
+		{textDelta(0, "whole answer")},
+	}}
+
+	var out bytes.Buffer
+	session, err := NewSession(client, "llama3", strings.NewReader("hi\n"), &out, Config{Stream: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out.String(), "whole answer") != 1 {
+		t.Errorf("expected the answer exactly once in output, got %q", out.String())
+	}
+}
+
+func TestSessionRun_StreamErrorLeavesNoPartialMessage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.hjl")
+	client := &fakeGen{turns: [][]*gen.StreamResponse{
+		{textDelta(0, "half an "), {Type: gen.TYPE_ERROR, Content: "connection reset"}},
+	}}
+
+	session, err := NewSession(client, "fake-model", strings.NewReader("hi\n"), &bytes.Buffer{},
+		Config{Serializer: NewFileSerializer(path), Stream: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.Run(t.Context()); err == nil {
+		t.Fatal("expected error")
+	}
+
+	for _, p := range readSessionFile(t, path) {
+		if p.Role == prompt.AssistantRole {
+			t.Errorf("unexpected assistant prompt in session file: %+v", p)
+		}
+	}
+}
+
+func TestSessionRun_InterruptToolCall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.hjl")
+	client := &fakeGen{turns: [][]*gen.StreamResponse{
+		{toolDelta(0, "call-1", "block", `{}`), toolDelta(1, "call-2", "block", `{}`)},
+	}}
+
+	var session *Session
+	blockTool := tools.NewTool("block",
+		tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			if !session.Interrupt() {
+				t.Error("expected an in-flight turn to interrupt")
+			}
+			<-ctx.Done()
+			return "partial output", nil
+		}))
+
+	session, err := NewSession(client, "fake-model", strings.NewReader("hi\n"), &bytes.Buffer{},
+		Config{Serializer: NewFileSerializer(path), Tools: []tools.Tool{blockTool}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if session.Interrupt() {
+		t.Error("expected no in-flight turn after Run returned")
+	}
+
+	// the interrupted turn must not re-prompt the model, and every tool call
+	// must still have a response.
+	if client.calls != 1 {
+		t.Errorf("expected 1 model request, got %d", client.calls)
+	}
+	history := readSessionFile(t, path)
+	if len(history) != 6 {
+		t.Fatalf("expected 6 prompts in session file, got %d", len(history))
+	}
+	for i, id := range []string{"call-1", "call-2"} {
+		resp := history[3+2*i].ToolResponse
+		if resp == nil || resp.ToolCallID != id {
+			t.Fatalf("expected tool response for %s, got %+v", id, history[3+2*i])
+		}
+		if !strings.Contains(resp.Response, interruptedNote) {
+			t.Errorf("expected interruption note in %q", resp.Response)
+		}
+	}
+	if !strings.Contains(history[3].ToolResponse.Response, "partial output") {
+		t.Errorf("expected partial output to be kept, got %q", history[3].ToolResponse.Response)
+	}
+}
+
+func TestSessionRun_ParallelReadOnlyTools(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.hjl")
+	client := &fakeGen{turns: [][]*gen.StreamResponse{
+		{
+			toolDelta(0, "call-1", "read_file", `{"path":"slow"}`),
+			toolDelta(1, "call-2", "read_file", `{"path":"fast"}`),
+			toolDelta(2, "call-3", "edit_file", `{}`),
+		},
+		{textDelta(0, "done")},
+	}}
+
+	// both read_file calls must be running at once for either to finish.
+	started := make(chan struct{}, 2)
+	readTool := tools.NewTool("read_file",
+		tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			started <- struct{}{}
+			for len(started) < 2 {
+				select {
+				case <-ctx.Done():
+					return "", ctx.Err()
+				case <-time.After(time.Millisecond):
+				}
+			}
+			return "read " + string(call.Argument), nil
+		}))
+	editTool := tools.NewTool("edit_file",
+		tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			return "edited", nil
+		}))
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	session, err := NewSession(client, "fake-model", strings.NewReader("hi\n"), &bytes.Buffer{},
+		Config{Serializer: NewFileSerializer(path), Tools: []tools.Tool{readTool, editTool}, ToolWorkers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range readSessionFile(t, path) {
+		if p.ToolResponse != nil {
+			resp := p.ToolResponse.Response
+			got = append(got, p.ToolResponse.ToolCallID+"="+resp[strings.Index(resp, "]\n")+2:])
+		}
+	}
+	expected := `call-1=read {"path":"slow"} call-2=read {"path":"fast"} call-3=edited`
+	if strings.Join(got, " ") != expected {
+		t.Errorf("expected %q, got %q", expected, strings.Join(got, " "))
+	}
+}
+
+func TestSessionRun_PersistentShellContext(t *testing.T) {
+	dir := t.TempDir()
+	client := &fakeGen{turns: [][]*gen.StreamResponse{
+		{toolDelta(0, "call-1", "bash", `{"command":"cd `+dir+`"}`)},
+		{textDelta(0, "moved")},
+		{textDelta(0, "still there")},
+	}}
+
+	session, err := NewSession(client, "fake-model", strings.NewReader("go\nagain\n"), &bytes.Buffer{},
+		Config{Tools: []tools.Tool{atools.BashTool}, PersistentShell: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	var contexts []string
+	for _, p := range session.history {
+		if p.Role == prompt.UserRole && strings.HasPrefix(p.Text, "Working directory:") {
+			contexts = append(contexts, p.Text)
+		}
+	}
+	if len(contexts) != 2 || !strings.Contains(contexts[1], "Shell working directory: "+dir+" ") {
+		t.Errorf("expected an updated context message after cd, got %q", contexts)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/tools"
+)
+
+// streamAssembler collects streamed deltas into a complete gen.Response,
+// echoing text and thinking deltas to an output writer as they arrive.
+type streamAssembler struct {
+	output io.Writer
+
+	resp gen.Response
+
+	// the segment currently being written to output. a new segment starts
+	// whenever the delta type or content index changes.
+	cur      strings.Builder
+	curType  gen.StreamingResponseType
+	curIndex int
+	open     bool
+
+	calls     map[string]*tools.Call
+	callOrder []string
+}
+
+func newStreamAssembler(output io.Writer) *streamAssembler {
+	return &streamAssembler{
+		output: output,
+		calls:  map[string]*tools.Call{},
+	}
+}
+
+func (a *streamAssembler) startSegment(typ gen.StreamingResponseType, index int) error {
+	if a.open && a.curType == typ && a.curIndex == index {
+		return nil
+	}
+	if err := a.endSegment(); err != nil {
+		return err
+	}
+	a.open, a.curType, a.curIndex = true, typ, index
+	if typ == gen.TYPE_THINKING_DELTA {
+		_, err := fmt.Fprint(a.output, "<thought>\n")
+		return err
+	}
+	return nil
+}
+
+func (a *streamAssembler) endSegment() error {
+	if !a.open {
+		return nil
+	}
+	a.open = false
+	content := a.cur.String()
+	a.cur.Reset()
+	if a.curType == gen.TYPE_THINKING_DELTA {
+		a.resp.Thinking = append(a.resp.Thinking, content)
+		_, err := fmt.Fprint(a.output, "\n</thought>\n\n")
+		return err
+	}
+	a.resp.Texts = append(a.resp.Texts, content)
+	_, err := fmt.Fprint(a.output, "\n\n")
+	return err
+}
+
+func (a *streamAssembler) addToolCall(call *tools.Call) {
+	existing, ok := a.calls[call.ID]
+	if !ok {
+		cp := *call
+		cp.Argument = append([]byte(nil), call.Argument...)
+		a.calls[call.ID] = &cp
+		a.callOrder = append(a.callOrder, call.ID)
+		return
+	}
+	existing.Argument = append(existing.Argument, call.Argument...)
+	if existing.ThoughtSignature == "" {
+		existing.ThoughtSignature = call.ThoughtSignature
+	}
+	if existing.Ref == nil {
+		existing.Ref = call.Ref
+	}
+}
+
+func (a *streamAssembler) addMetadata(m *gen.StreamResponse) {
+	// providers may report usage in several chunks (e.g. input tokens at
+	// message start, output tokens at message end), so keep the largest
+	// value seen for each counter.
+	md := &a.resp.Metadata
+	if m.Metadata.Model != "" {
+		md.Model = m.Metadata.Model
+	}
+	md.InputTokens = max(md.InputTokens, m.Metadata.InputTokens)
+	md.OutputTokens = max(md.OutputTokens, m.Metadata.OutputTokens)
+	md.ThinkingTokens = max(md.ThinkingTokens, m.Metadata.ThinkingTokens)
+	md.TotalTokens = max(md.TotalTokens, m.Metadata.TotalTokens)
+}
+
+// Add processes a single stream chunk. It returns true once the stream
+// has signaled completion.
+func (a *streamAssembler) Add(chunk *gen.StreamResponse) (done bool, err error) {
+	switch chunk.Type {
+	case gen.TYPE_ERROR:
+		return true, chunk.Error()
+	case gen.TYPE_EOF:
+		return true, nil
+	case gen.TYPE_METADATA:
+		if chunk.Metadata != nil {
+			a.addMetadata(chunk)
+		}
+	case gen.TYPE_THINKING_DELTA:
+		if err := a.startSegment(chunk.Type, chunk.Index); err != nil {
+			return true, err
+		}
+		a.cur.WriteString(chunk.Content)
+		_, err = fmt.Fprint(a.output, chunk.Content)
+		return false, err
+	case gen.TYPE_DELTA:
+		if chunk.ToolCall != nil {
+			a.addToolCall(chunk.ToolCall)
+			return false, nil
+		}
+		if chunk.Content == "" {
+			return false, nil
+		}
+		if err := a.startSegment(chunk.Type, chunk.Index); err != nil {
+			return true, err
+		}
+		a.cur.WriteString(chunk.Content)
+		_, err = fmt.Fprint(a.output, chunk.Content)
+		return false, err
+	}
+	return false, nil
+}
+
+// Response finishes any open segment and returns the assembled response.
+func (a *streamAssembler) Response() (*gen.Response, error) {
+	if err := a.endSegment(); err != nil {
+		return nil, err
+	}
+	for _, id := range a.callOrder {
+		call := *a.calls[id]
+		if len(call.Argument) == 0 {
+			call.Argument = []byte("{}")
+		}
+		a.resp.Tools = append(a.resp.Tools, call)
+	}
+	return &a.resp, nil
+}
+
+// readStream consumes a stream until completion, echoing deltas to output.
+// The stream is always drained so the provider's goroutine can exit.
+func readStream(stream <-chan *gen.StreamResponse, output io.Writer) (*gen.Response, error) {
+	a := newStreamAssembler(output)
+	defer func() {
+		go func() {
+			for range stream {
+			}
+		}()
+	}()
+	for chunk := range stream {
+		if chunk == nil {
+			continue
+		}
+		done, err := a.Add(chunk)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+	return a.Response()
+}
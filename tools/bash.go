@@ -1,50 +1,338 @@
 package tools
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/modfin/bellman/tools"
 )
 
 const (
-	bashTimeout   = 60 * time.Second
-	bashMaxOutput = 8 * 1024
+	bashTimeout = 60 * time.Second
+	// bashMaxTimeout is the longest timeout BashTool allows a call to ask
+	// for.
+	bashMaxTimeout = 10 * time.Minute
+	// bashOutputHead and bashOutputTail are how much of the start and end
+	// of a command's output BashTool keeps when truncating.
+	bashOutputHead = 2 * 1024
+	bashOutputTail = 6 * 1024
 )
 
+// BashConfig configures the bash tool. Zero values get defaults.
+type BashConfig struct {
+	// MaxTimeout bounds the timeout a single call may ask for.
+	MaxTimeout time.Duration
+	// OutputHead and OutputTail are how many bytes of the start and end of
+	// a command's output (stdout and stderr together) are kept when it is
+	// too long to return in full.
+	OutputHead, OutputTail int
+	// Env is set in every command's environment.
+	Env map[string]string
+	// ScrubEnv holds glob patterns (e.g. "*API_KEY*") of environment
+	// variables to remove from ajent's own environment before passing it
+	// on, so the model can't read secrets like provider keys.
+	ScrubEnv []string
+}
+
 type bashArgs struct {
-	Command string `json:"command" json-description:"The bash command to execute"`
+	Command    string `json:"command" json-description:"The bash command to execute"`
+	Timeout    int    `json:"timeout,omitempty" json-description:"Timeout in seconds (default 60). Use a longer timeout for slow builds or test suites."`
+	Background bool   `json:"background,omitempty" json-description:"Run the command in the background and return a job ID immediately, for servers, watchers and other long-running commands. Use bash_output, bash_stdin and bash_kill to manage the job."`
+
+	Cwd   string            `json:"cwd,omitempty" json-description:"Directory to run the command in, instead of the current working directory. Doesn't change the working directory of later commands."`
+	Env   map[string]string `json:"env,omitempty" json-description:"Environment variables to set for this command only"`
+	Stdin string            `json:"stdin,omitempty" json-description:"Content to send to the command's stdin. Without it, stdin is empty."`
 }
 
-var BashTool = tools.NewTool("bash",
-	tools.WithDescription("Execute a bash command and return its combined stdout and stderr output. Output is limited to 8KB (tail is kept). For commands with large output, redirect to a file and use read_file or grep_file to inspect it."),
-	tools.WithArgSchema(bashArgs{}),
-	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
-		var params bashArgs
-		if err := json.Unmarshal(call.Argument, &params); err != nil {
-			return fmt.Sprintf("error: invalid arguments: %v", err), nil
-		}
-		if params.Command == "" {
-			return "error: command is required", nil
-		}
+var BashTool = NewBashTool(BashConfig{})
+
+// bashResult is the outcome of running a bash command.
+type bashResult struct {
+	stdout, stderr []byte
+	// combined is stdout and stderr interleaved as they were written.
+	combined []byte
+	// exitCode is -1 if the command didn't exit normally.
+	exitCode int
+	// notes are extra header lines, such as why there is no exit code.
+	notes []string
+}
+
+// outputCollector captures a command's stdout and stderr both separately
+// and interleaved.
+type outputCollector struct {
+	mu             sync.Mutex
+	stdout, stderr bytes.Buffer
+	combined       bytes.Buffer
+}
+
+type collectorStream struct {
+	c   *outputCollector
+	buf *bytes.Buffer
+}
+
+func (s collectorStream) Write(p []byte) (int, error) {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	s.buf.Write(p)
+	s.c.combined.Write(p)
+	return len(p), nil
+}
+
+func (c *outputCollector) streams() (stdout, stderr collectorStream) {
+	return collectorStream{c: c, buf: &c.stdout}, collectorStream{c: c, buf: &c.stderr}
+}
+
+func (c *outputCollector) result() bashResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bashResult{
+		stdout:   bytes.Clone(c.stdout.Bytes()),
+		stderr:   bytes.Clone(c.stderr.Bytes()),
+		combined: bytes.Clone(c.combined.Bytes()),
+		exitCode: -1,
+	}
+}
+
+// truncateMiddle keeps the first head and last tail bytes of data, snapped
+// to line boundaries where possible, with a marker saying how much was
+// elided in between.
+func truncateMiddle(data []byte, head, tail int) []byte {
+	if len(data) <= head+tail {
+		return data
+	}
+	h := data[:head]
+	if i := bytes.LastIndexByte(h, '\n'); i >= 0 {
+		h = h[:i+1]
+	}
+	t := data[len(data)-tail:]
+	if i := bytes.IndexByte(t, '\n'); i >= 0 && i < len(t)-1 {
+		t = t[i+1:]
+	}
+	elided := len(data) - len(h) - len(t)
+	var rv bytes.Buffer
+	rv.Write(h)
+	if len(h) > 0 && h[len(h)-1] != '\n' {
+		rv.WriteByte('\n')
+	}
+	fmt.Fprintf(&rv, "[... %d bytes elided ...]\n", elided)
+	rv.Write(t)
+	return rv.Bytes()
+}
 
-		ctx, cancel := context.WithTimeout(ctx, bashTimeout)
-		defer cancel()
+// format renders r for the model: a header with the exit code and stream
+// sizes, followed by each non-empty stream. The streams share one
+// OutputHead+OutputTail budget; if they have to be truncated to fit, the
+// full combined output is saved to a scratch file and its path is
+// included in the header.
+func (r bashResult) format(ctx context.Context, cfg BashConfig) string {
+	var sb strings.Builder
+	if r.exitCode >= 0 {
+		fmt.Fprintf(&sb, "exit code: %d\n", r.exitCode)
+	} else {
+		sb.WriteString("exit code: none\n")
+	}
+	for _, note := range r.notes {
+		sb.WriteString(note + "\n")
+	}
 
-		cmd := exec.CommandContext(ctx, "bash", "-c", params.Command)
-		output, err := cmd.CombinedOutput()
-		if len(output) > bashMaxOutput {
-			output = append([]byte("[output truncated]\n"), output[len(output)-bashMaxOutput:]...)
+	// split the budget between the streams, letting a short one keep all
+	// of its output.
+	budget := cfg.OutputHead + cfg.OutputTail
+	outShare, errShare := len(r.stdout), len(r.stderr)
+	if outShare+errShare > budget {
+		small := min(outShare, errShare, budget/2)
+		if outShare <= errShare {
+			outShare, errShare = small, budget-small
+		} else {
+			outShare, errShare = budget-small, small
 		}
-		if ctx.Err() == context.DeadlineExceeded {
-			return fmt.Sprintf("error: command timed out after %v\n%s", bashTimeout, string(output)), nil
+	}
+	streams := []struct {
+		name  string
+		data  []byte
+		share int
+	}{{"stdout", r.stdout, outShare}, {"stderr", r.stderr, errShare}}
+
+	truncated := false
+	for _, stream := range streams {
+		fmt.Fprintf(&sb, "%s: %d bytes", stream.name, len(stream.data))
+		if len(stream.data) > stream.share {
+			truncated = true
+			sb.WriteString(" (truncated)")
 		}
-		if err != nil {
-			return fmt.Sprintf("exit status: %v\n%s", err, string(output)), nil
+		sb.WriteString("\n")
+	}
+	if truncated {
+		writeFullOutput(ctx, &sb, "bash", r.combined)
+	}
+
+	for _, stream := range streams {
+		if len(stream.data) == 0 {
+			continue
 		}
-		return string(output), nil
-	}),
-)
+		head := stream.share * cfg.OutputHead / budget
+		data := truncateMiddle(stream.data, head, stream.share-head)
+		fmt.Fprintf(&sb, "<%s>\n%s", stream.name, data)
+		if data[len(data)-1] != '\n' {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "</%s>\n", stream.name)
+	}
+	return sb.String()
+}
+
+// writeFullOutput saves data, a command's whole output, to a scratch file
+// named after prefix, and writes a header line with its path to sb.
+func writeFullOutput(ctx context.Context, sb *strings.Builder, prefix string, data []byte) {
+	path, err := saveScratch(ctx, prefix, data)
+	if err != nil {
+		fmt.Fprintf(sb, "full output: not saved: %v\n", err)
+		return
+	}
+	fmt.Fprintf(sb, "full output: %s\n", path)
+	if scratchFromContext(ctx) != nil {
+		// the scratch directory goes away with the session, so the path is
+		// gone if the session is reopened later.
+		sb.WriteString("(the full output file is deleted when ajent exits)\n")
+	}
+}
+
+// withDefaults returns cfg with defaults in place of its zero values.
+// Negative output sizes count as zero.
+func (cfg BashConfig) withDefaults() BashConfig {
+	if cfg.MaxTimeout <= 0 {
+		cfg.MaxTimeout = bashMaxTimeout
+	}
+	if cfg.OutputHead <= 0 && cfg.OutputTail <= 0 {
+		cfg.OutputHead, cfg.OutputTail = bashOutputHead, bashOutputTail
+	}
+	cfg.OutputHead, cfg.OutputTail = max(cfg.OutputHead, 0), max(cfg.OutputTail, 0)
+	return cfg
+}
+
+// NewBashTool returns the bash tool.
+func NewBashTool(cfg BashConfig) tools.Tool {
+	cfg = cfg.withDefaults()
+	return tools.NewTool("bash",
+		tools.WithDescription(fmt.Sprintf("Execute a bash command. Returns a header with the exit code and the size of stdout and stderr, followed by each of them. Long output keeps its first %d and last %d bytes (split between stdout and stderr), and the full output is saved to a temporary file (named in the header, and deleted when ajent exits) that you can inspect with read_file or grep_file. Commands time out after 60 seconds unless a longer timeout (up to %v) is given; run servers and other long-running commands with background set.", cfg.OutputHead, cfg.OutputTail, cfg.MaxTimeout)),
+		tools.WithArgSchema(bashArgs{}),
+		tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			var params bashArgs
+			if err := json.Unmarshal(call.Argument, &params); err != nil {
+				return fmt.Sprintf("error: invalid arguments: %v", err), nil
+			}
+			if params.Command == "" {
+				return "error: command is required", nil
+			}
+			if err := checkEnv(params.Env); err != nil {
+				return fmt.Sprintf("error: %v", err), nil
+			}
+			env := cfg.environ(params.Env)
+			sh := shellFromContext(ctx)
+
+			if params.Background {
+				js := jobsFromContext(ctx)
+				if js == nil {
+					return "error: background jobs are not available in this session", nil
+				}
+				dir := params.Cwd
+				if sh != nil && !filepath.IsAbs(dir) {
+					dir = filepath.Join(sh.Dir(), dir)
+				}
+				j, err := js.start(ctx, params.Command, dir, env, params.Stdin)
+				if err != nil {
+					return fmt.Sprintf("error: %v", err), nil
+				}
+				return fmt.Sprintf("ok: started %s in the background. Use bash_output to get its output.", j.id), nil
+			}
+
+			timeout := bashTimeout
+			if params.Timeout > 0 {
+				timeout = min(time.Duration(params.Timeout)*time.Second, cfg.MaxTimeout)
+			}
+			runCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			var r bashResult
+			if sh != nil {
+				stdinPath := ""
+				if params.Stdin != "" {
+					var err error
+					if stdinPath, err = saveScratch(ctx, "stdin", []byte(params.Stdin)); err != nil {
+						return fmt.Sprintf("error: %v", err), nil
+					}
+				}
+				command := wrapShellCommand(params.Command, params.Cwd, params.Env, stdinPath)
+				// the shell outlives this call, so it only gets the
+				// session-wide environment.
+				r = runInShell(runCtx, sh, command, cfg.environ(nil))
+			} else {
+				r = runBash(runCtx, params.Command, params.Cwd, env, params.Stdin)
+			}
+			if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+				r.notes = append([]string{fmt.Sprintf("timed out after %v", timeout)}, r.notes...)
+			}
+			return r.format(ctx, cfg), nil
+		}),
+	)
+}
+
+// runBash runs command in a fresh bash process.
+func runBash(ctx context.Context, command, dir string, env []string, stdin string) bashResult {
+	var c outputCollector
+	cmd := exec.CommandContext(ctx, "bash", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout, cmd.Stderr = c.streams()
+	// kill anything the command started too, and don't wait forever on
+	// children that outlive it while holding its output open.
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return signalProcessGroup(cmd, syscall.SIGKILL) }
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+
+	r := c.result()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		r.exitCode = 0
+	case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+		r.exitCode = exitErr.ExitCode()
+	case errors.As(err, &exitErr):
+		r.notes = append(r.notes, fmt.Sprintf("terminated: %v", err))
+	case ctx.Err() == nil:
+		r.notes = append(r.notes, fmt.Sprintf("error: %v", err))
+	}
+	return r
+}
+
+// saveScratch writes data to a new file in the context's scratch directory,
+// or the system temp directory if there isn't one, and returns its path.
+func saveScratch(ctx context.Context, prefix string, data []byte) (string, error) {
+	var fh *os.File
+	var err error
+	if sc := scratchFromContext(ctx); sc != nil {
+		fh, err = sc.create(prefix)
+	} else {
+		fh, err = os.CreateTemp("", "ajent-"+prefix+"-*.log")
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := fh.Write(data); err != nil {
+		_ = fh.Close()
+		return "", err
+	}
+	return fh.Name(), fh.Close()
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/modfin/bellman/tools"
 )
@@ -15,7 +16,7 @@ type createFileArgs struct {
 }
 
 var CreateFileTool = tools.NewTool("create_file",
-	tools.WithDescription("Create a new file with the given content. Refuses to overwrite existing files. Returns hashline-formatted content of the created file. Use bash/mkdir to create parent directories if needed."),
+	tools.WithDescription("Create a new file with the given content. Refuses to overwrite existing files, but recreates one that was deleted since you read it, with a warning. Returns hashline-formatted content of the created file. Use bash/mkdir to create parent directories if needed."),
 	tools.WithArgSchema(createFileArgs{}),
 	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
 		var params createFileArgs
@@ -30,19 +31,24 @@ var CreateFileTool = tools.NewTool("create_file",
 			return fmt.Sprintf("error: file already exists: %s", params.Path), nil
 		}
 
-		if err := os.WriteFile(params.Path, []byte(params.Content), 0644); err != nil {
+		change := checkFile(ctx, params.Path)
+		if err := snapshot(ctx, call, params.Path); err != nil {
 			return fmt.Sprintf("error: %v", err), nil
 		}
+		if err := writeFileAtomic(params.Path, []byte(params.Content), 0644, refuseSymlinks); err != nil {
+			return fmt.Sprintf("error: %v", err), nil
+		}
+		recordRead(ctx, params.Path, []byte(params.Content))
 
 		lines, _, err := readFileLines(params.Path)
 		if err != nil {
 			return fmt.Sprintf("ok: created %s but error reading back: %v", params.Path, err), nil
 		}
 		if len(lines) == 0 {
-			return fmt.Sprintf("ok: created %s (empty file)", params.Path), nil
+			return strings.TrimSuffix(fmt.Sprintf("ok: created %s (empty file)\n%s", params.Path, change.warning(params.Path)), "\n"), nil
 		}
 
 		diff := GenerateDiff(params.Path, "", params.Content)
-		return fmt.Sprintf("ok: created %s (%d lines)\n\nDiff:\n%s\nHashlines:\n%s", params.Path, len(lines), diff, formatHashlines(lines, 0)), nil
+		return fmt.Sprintf("ok: created %s (%d lines)\n%s\nDiff:\n%s\nHashlines:\n%s", params.Path, len(lines), change.warning(params.Path), diff, formatHashlines(lines, 0, hashWidthFromContext(ctx))), nil
 	}),
 )
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/modfin/bellman/tools"
@@ -12,14 +13,46 @@ import (
 
 type editFileArgs struct {
 	Path      string `json:"path" json-description:"The path to the file to edit"`
+	Operation string `json:"operation,omitempty" json-description:"The edit operation: replace or insert_after" json-enum:"replace,insert_after"`
+	Start     string `json:"start,omitempty" json-description:"Hashline reference for the target line (format: line_number:hash, e.g. 5:a3)"`
+	End       string `json:"end,omitempty" json-description:"Hashline reference for end of a range (format: line_number:hash). Only used with replace for multi-line ranges. If omitted, only the start line is replaced."`
+	Content   string `json:"content,omitempty" json-description:"The new content to insert or replace with. Use newlines for multiple lines. Empty string with replace deletes lines."`
+
+	Version string `json:"version,omitempty" json-description:"The file's version from the read_file header. If given, the edit is refused if the file has changed since, even if the line hashes still match."`
+
+	Edits []editOp `json:"edits,omitempty" json-description:"Several edits to apply at once, instead of operation/start/end/content. All references are to the file as last read, so line numbers don't shift between edits. The edits must not overlap, and are applied all together or not at all."`
+}
+
+// editOp is a single edit within an edit_file call.
+type editOp struct {
 	Operation string `json:"operation" json-description:"The edit operation: replace or insert_after" json-enum:"replace,insert_after"`
 	Start     string `json:"start" json-description:"Hashline reference for the target line (format: line_number:hash, e.g. 5:a3)"`
-	End       string `json:"end,omitempty" json-description:"Hashline reference for end of a range (format: line_number:hash). Only used with replace for multi-line ranges. If omitted, only the start line is replaced."`
-	Content   string `json:"content" json-description:"The new content to insert or replace with. Use newlines for multiple lines. Empty string with replace deletes lines."`
+	End       string `json:"end,omitempty" json-description:"Hashline reference for end of a range to replace (format: line_number:hash). If omitted, only the start line is replaced."`
+	Content   string `json:"content" json-description:"The new content to insert or replace with. Empty string with replace deletes lines."`
+}
+
+// resolvedEdit is an editOp checked against the file's lines. It replaces
+// the 1-indexed lines start through end with newLines; an insert_after
+// has end == start-1, replacing nothing.
+type resolvedEdit struct {
+	index      int
+	start, end int
+	newLines   []string
+}
+
+func (e resolvedEdit) describe(ops []editOp) string {
+	op := ops[e.index]
+	if op.Operation == "insert_after" {
+		return fmt.Sprintf("edit %d (insert_after line %d)", e.index+1, e.end)
+	}
+	if e.start == e.end {
+		return fmt.Sprintf("edit %d (replace line %d)", e.index+1, e.start)
+	}
+	return fmt.Sprintf("edit %d (replace lines %d-%d)", e.index+1, e.start, e.end)
 }
 
 // formatContextLines returns a few lines around targetLine (1-indexed) in hashline format for error messages.
-func formatContextLines(lines []string, targetLine, contextRadius int) string {
+func formatContextLines(lines []string, targetLine, contextRadius, width int) string {
 	start := targetLine - contextRadius
 	if start < 1 {
 		start = 1
@@ -30,14 +63,132 @@ func formatContextLines(lines []string, targetLine, contextRadius int) string {
 	}
 	var sb strings.Builder
 	for i := start; i <= end; i++ {
-		hash := hashLineContent(lines[i-1])
-		fmt.Fprintf(&sb, "  %d:%s|%s\n", i, hash, lines[i-1])
+		hash := hashLine(lines[i-1], width)
+		fmt.Fprintf(&sb, "  %d:%s|%s\n", i, hash, capLine(lines[i-1], len(lines[i-1])))
 	}
 	return sb.String()
 }
 
+// checkHashlineRef parses ref and validates it against lines, returning
+// the referenced line number. The error includes the file's current
+// content around the line.
+func checkHashlineRef(lines []string, ref string) (int, error) {
+	line, hash, err := parseHashlineRef(ref)
+	if err != nil {
+		return 0, err
+	}
+	if err := validateHashlineRef(lines, line, hash); err != nil {
+		if len(hash) < DefaultHashWidth || len(hash) > MaxHashWidth {
+			return 0, err
+		}
+		// Provide context in the error message, with hashes as wide as the
+		// reference's
+		width := max(len(hash), DefaultHashWidth)
+		if line > len(lines) {
+			// Out of bounds: show the last few lines
+			ctx := formatContextLines(lines, len(lines), 2, width)
+			return 0, fmt.Errorf("line %d does not exist (file has %d lines)\nEnd of file:\n%s", line, len(lines), ctx)
+		}
+		// Hash mismatch: show context around the target line
+		ctx := formatContextLines(lines, line, 3, width)
+		return 0, fmt.Errorf("hash mismatch at line %d: expected %s, got %s (file has changed since last read)\nCurrent content around line %d:\n%s",
+			line, hash, hashLine(lines[line-1], len(hash)), line, ctx)
+	}
+	return line, nil
+}
+
+// resolveEdit checks the edit ops[index] against lines.
+func resolveEdit(lines []string, ops []editOp, index int) (resolvedEdit, error) {
+	op := ops[index]
+	if op.Operation == "" {
+		return resolvedEdit{}, fmt.Errorf("operation is required")
+	}
+	if op.Start == "" {
+		return resolvedEdit{}, fmt.Errorf("start is required")
+	}
+	if op.Operation != "replace" && op.Operation != "insert_after" {
+		return resolvedEdit{}, fmt.Errorf("unknown operation %q", op.Operation)
+	}
+	startLine, err := checkHashlineRef(lines, op.Start)
+	if err != nil {
+		return resolvedEdit{}, err
+	}
+
+	e := resolvedEdit{index: index}
+	if op.Content != "" {
+		e.newLines = strings.Split(op.Content, "\n")
+	}
+	if op.Operation == "insert_after" {
+		e.start, e.end = startLine+1, startLine
+		return e, nil
+	}
+	e.start, e.end = startLine, startLine
+	if op.End != "" {
+		if e.end, err = checkHashlineRef(lines, op.End); err != nil {
+			return resolvedEdit{}, err
+		}
+		if e.end < startLine {
+			return resolvedEdit{}, fmt.Errorf("end line %d is before start line %d", e.end, startLine)
+		}
+	}
+	return e, nil
+}
+
+// applyEdits applies edits, which all refer to the original lines, in one
+// pass. It fails if any edits overlap: two replaced ranges sharing a line,
+// or an insert_after targeting a line that another edit replaces. Several
+// inserts after the same line are applied in the order given.
+func applyEdits(lines []string, edits []resolvedEdit, ops []editOp) ([]string, error) {
+	for i, a := range edits {
+		for _, b := range edits[i+1:] {
+			aInsert, bInsert := a.end < a.start, b.end < b.start
+			var overlap bool
+			switch {
+			case aInsert && bInsert:
+			case aInsert:
+				overlap = b.start <= a.end && a.end <= b.end
+			case bInsert:
+				overlap = a.start <= b.end && b.end <= a.end
+			default:
+				overlap = a.start <= b.end && b.start <= a.end
+			}
+			if overlap {
+				return nil, fmt.Errorf("%s overlaps %s", b.describe(ops), a.describe(ops))
+			}
+		}
+	}
+
+	sorted := slices.Clone(edits)
+	slices.SortStableFunc(sorted, func(a, b resolvedEdit) int {
+		if a.start != b.start {
+			return a.start - b.start
+		}
+		// an insert before a replaced range at the same position goes first.
+		return cmpBool(a.end >= a.start, b.end >= b.start)
+	})
+	var result []string
+	next := 1 // the next original line to copy
+	for _, e := range sorted {
+		result = append(result, lines[next-1:e.start-1]...)
+		result = append(result, e.newLines...)
+		next = e.end + 1
+	}
+	return append(result, lines[next-1:]...), nil
+}
+
+// cmpBool orders false before true.
+func cmpBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
+
 var EditFileTool = tools.NewTool("edit_file",
-	tools.WithDescription("Edit a file using hashline references from read_file. Supports replacing lines (single or range) and inserting after a line. The hash in each reference is validated to ensure the file hasn't changed since it was last read."),
+	tools.WithDescription("Edit a file using hashline references from read_file. Supports replacing lines (single or range) and inserting after a line, either as a single edit or as an edits array of several non-overlapping edits, all referring to the file as last read, that are applied together. The hash in each reference is validated to ensure the file hasn't changed since it was last read; pass the version from read_file for a stricter check. If the file has changed on disk since you last read it, the edit is refused and the changed lines are shown. The result includes the file's new version."),
 	tools.WithArgSchema(editFileArgs{}),
 	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
 		var params editFileArgs
@@ -47,100 +198,61 @@ var EditFileTool = tools.NewTool("edit_file",
 		if params.Path == "" {
 			return "error: path is required", nil
 		}
-		if params.Operation == "" {
-			return "error: operation is required", nil
-		}
-		if params.Start == "" {
-			return "error: start is required", nil
+		ops := params.Edits
+		single := len(ops) == 0
+		if single {
+			ops = []editOp{{Operation: params.Operation, Start: params.Start, End: params.End, Content: params.Content}}
+		} else if params.Operation != "" || params.Start != "" || params.End != "" || params.Content != "" {
+			return "error: use either edits or operation/start/end/content, not both", nil
 		}
 
-		oldData, _ := os.ReadFile(params.Path)
-		oldContent := string(oldData)
-		lines, endsWithNewline, err := readFileLines(params.Path)
-		if err != nil {
-			return fmt.Sprintf("error: %v", err), nil
+		change := checkFile(ctx, params.Path)
+		if change.changed() {
+			return fmt.Sprintf("error: %s changed on disk since you last read it:\n%sNo edits were applied. Check that your references still apply to the new content, then try again.", params.Path, change.diff), nil
 		}
-
-		startLine, startHash, err := parseHashlineRef(params.Start)
+		oldData, err := os.ReadFile(params.Path)
 		if err != nil {
 			return fmt.Sprintf("error: %v", err), nil
 		}
-
-		if err := validateHashlineRef(lines, startLine, startHash); err != nil {
-			// Provide context in the error message
-			if startLine > len(lines) {
-				// Out of bounds: show the last few lines
-				lastStart := len(lines) - 2
-				if lastStart < 1 {
-					lastStart = 1
-				}
-				ctx := formatContextLines(lines, len(lines), 2)
-				return fmt.Sprintf("error: line %d does not exist (file has %d lines)\nEnd of file:\n%s", startLine, len(lines), ctx), nil
-			}
-			// Hash mismatch: show context around the target line
-			ctx := formatContextLines(lines, startLine, 3)
-			return fmt.Sprintf("error: hash mismatch at line %d: expected %s, got %s (file has changed since last read)\nCurrent content around line %d:\n%s",
-				startLine, startHash, hashLineContent(lines[startLine-1]), startLine, ctx), nil
-		}
-
-		var newLines []string
-		if params.Content != "" {
-			newLines = strings.Split(params.Content, "\n")
+		oldContent := string(oldData)
+		if params.Version != "" && params.Version != fileVersion(oldData) {
+			return fmt.Sprintf("error: %s has changed since version %s was read (it is now version %s); read it again", params.Path, params.Version, fileVersion(oldData)), nil
 		}
+		lines, endsWithNewline := splitLines(oldContent)
 
-		switch params.Operation {
-		case "replace":
-			endLine := startLine
-			if params.End != "" {
-				var endHash string
-				endLine, endHash, err = parseHashlineRef(params.End)
-				if err != nil {
+		edits := make([]resolvedEdit, 0, len(ops))
+		for i := range ops {
+			e, err := resolveEdit(lines, ops, i)
+			if err != nil {
+				if single {
 					return fmt.Sprintf("error: %v", err), nil
 				}
-				if err := validateHashlineRef(lines, endLine, endHash); err != nil {
-					if endLine > len(lines) {
-						lastStart := len(lines) - 2
-						if lastStart < 1 {
-							lastStart = 1
-						}
-						ctx := formatContextLines(lines, len(lines), 2)
-						return fmt.Sprintf("error: line %d does not exist (file has %d lines)\nEnd of file:\n%s", endLine, len(lines), ctx), nil
-					}
-					ctx := formatContextLines(lines, endLine, 3)
-					return fmt.Sprintf("error: hash mismatch at line %d: expected %s, got %s (file has changed since last read)\nCurrent content around line %d:\n%s",
-						endLine, endHash, hashLineContent(lines[endLine-1]), endLine, ctx), nil
-				}
-				if endLine < startLine {
-					return fmt.Sprintf("error: end line %d is before start line %d", endLine, startLine), nil
-				}
+				return fmt.Sprintf("error: edit %d: %v\nNo edits were applied.", i+1, err), nil
 			}
-
-			result := make([]string, 0, len(lines)-(endLine-startLine+1)+len(newLines))
-			result = append(result, lines[:startLine-1]...)
-			result = append(result, newLines...)
-			result = append(result, lines[endLine:]...)
-			lines = result
-
-		case "insert_after":
-			result := make([]string, 0, len(lines)+len(newLines))
-			result = append(result, lines[:startLine]...)
-			result = append(result, newLines...)
-			result = append(result, lines[startLine:]...)
-			lines = result
-
-		default:
-			return fmt.Sprintf("error: unknown operation %q", params.Operation), nil
+			edits = append(edits, e)
+		}
+		lines, err = applyEdits(lines, edits, ops)
+		if err != nil {
+			return fmt.Sprintf("error: %v\nNo edits were applied.", err), nil
 		}
 
 		content := strings.Join(lines, "\n")
 		if endsWithNewline || len(lines) > 0 {
 			content += "\n"
 		}
-		if err := os.WriteFile(params.Path, []byte(content), 0644); err != nil {
+		if err := snapshot(ctx, call, params.Path); err != nil {
+			return fmt.Sprintf("error: %v", err), nil
+		}
+		if err := writeFileAtomic(params.Path, []byte(content), 0644, followSymlinks); err != nil {
 			return fmt.Sprintf("error writing file: %v", err), nil
 		}
+		recordRead(ctx, params.Path, []byte(content))
 
 		diff := GenerateDiff(params.Path, oldContent, content)
-		return fmt.Sprintf("ok: %s applied to %s (%d lines)\n\n%s", params.Operation, params.Path, len(lines), diff), nil
+		applied := ops[0].Operation
+		if !single {
+			applied = fmt.Sprintf("%d edits", len(ops))
+		}
+		return fmt.Sprintf("ok: %s applied to %s (%d lines) [version %s]\n%s\n%s", applied, params.Path, len(lines), fileVersion([]byte(content)), change.warning(params.Path), diff), nil
 	}),
 )
@@ -0,0 +1,90 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var envNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// scrubbed reports whether the environment variable name matches one of
+// cfg.ScrubEnv's patterns. Matching ignores case.
+func (cfg BashConfig) scrubbed(name string) bool {
+	for _, pattern := range cfg.ScrubEnv {
+		if ok, _ := path.Match(strings.ToUpper(pattern), strings.ToUpper(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// environ returns the environment for a bash command: ajent's own
+// environment without the variables cfg scrubs, then the call's overrides,
+// then cfg.Env, which always wins.
+func (cfg BashConfig) environ(overrides map[string]string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if !cfg.scrubbed(name) {
+			env = append(env, kv)
+		}
+	}
+	for _, vars := range []map[string]string{overrides, cfg.Env} {
+		for _, name := range sortedKeys(vars) {
+			env = append(env, name+"="+vars[name])
+		}
+	}
+	// exec.Cmd uses the last value of duplicated variables.
+	return env
+}
+
+// checkEnv returns an error if any of env's names are invalid.
+func checkEnv(env map[string]string) error {
+	for name := range env {
+		if !envNameRE.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// shellQuote quotes s for use as a single bash word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// wrapShellCommand rewrites command to run in a subshell of the persistent
+// shell with its own working directory, environment overrides and stdin,
+// so none of them leak into later commands. Without any of them, command
+// is returned unchanged.
+func wrapShellCommand(command, cwd string, env map[string]string, stdinPath string) string {
+	if cwd == "" && len(env) == 0 && stdinPath == "" {
+		return command
+	}
+	var sb strings.Builder
+	sb.WriteString("(")
+	if cwd != "" {
+		fmt.Fprintf(&sb, "cd -- %s || exit; ", shellQuote(cwd))
+	}
+	for _, name := range sortedKeys(env) {
+		fmt.Fprintf(&sb, "export %s=%s; ", name, shellQuote(env[name]))
+	}
+	fmt.Fprintf(&sb, "eval %s)", shellQuote(command))
+	if stdinPath != "" {
+		fmt.Fprintf(&sb, " <%s", shellQuote(stdinPath))
+	}
+	return sb.String()
+}
@@ -0,0 +1,202 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileStateMaxContent is the largest file whose content FileTracker keeps,
+// so that it can show which lines changed.
+const fileStateMaxContent = 1024 * 1024
+
+// fileState is what a file looked like when the model last saw it.
+type fileState struct {
+	modTime time.Time
+	size    int64
+	version string
+	// content is nil if the file was too large to keep.
+	content []byte
+}
+
+// FileTracker remembers, for a session, the state of each file as of the
+// last time the model read or wrote it, so the mutating tools can tell
+// when a file has changed behind the model's back (say, in an editor, or
+// by a formatter run through bash).
+type FileTracker struct {
+	mu    sync.Mutex
+	files map[string]fileState
+}
+
+// NewFileTracker returns an empty FileTracker.
+func NewFileTracker() *FileTracker {
+	return &FileTracker{files: map[string]fileState{}}
+}
+
+func trackerKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// record notes that the model has seen data as the content of path.
+func (t *FileTracker) record(path string, data []byte) {
+	var content []byte
+	if len(data) <= fileStateMaxContent {
+		content = data
+	}
+	t.set(path, int64(len(data)), fileVersion(data), content)
+}
+
+// set notes that path, of the given size, has the given version and (if
+// it isn't nil) content.
+func (t *FileTracker) set(path string, size int64, version string, content []byte) {
+	st := fileState{size: size, version: version, content: content}
+	if info, err := os.Stat(path); err == nil {
+		st.modTime, st.size = info.ModTime(), info.Size()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.files[trackerKey(path)] = st
+}
+
+// fileChange describes how a file differs from when the model last saw it.
+type fileChange struct {
+	// unread is set if the model hasn't seen the file this session.
+	unread bool
+	// deleted is set if the file was seen but no longer exists.
+	deleted bool
+	// diff shows the changed lines, if the file was seen but has since
+	// changed.
+	diff string
+}
+
+func (c fileChange) changed() bool { return c.deleted || c.diff != "" }
+
+// check compares path with how the model last saw it. If it has changed
+// and update is set, the new state is recorded, since the model is about
+// to be told how.
+func (t *FileTracker) check(path string, update bool) fileChange {
+	info, statErr := os.Stat(path)
+	t.mu.Lock()
+	st, ok := t.files[trackerKey(path)]
+	t.mu.Unlock()
+	switch {
+	case !ok:
+		return fileChange{unread: statErr == nil}
+	case statErr != nil:
+		if update {
+			t.mu.Lock()
+			delete(t.files, trackerKey(path))
+			t.mu.Unlock()
+		}
+		return fileChange{deleted: true}
+	case info.ModTime().Equal(st.modTime) && info.Size() == st.size:
+		return fileChange{}
+	}
+
+	const tooLarge = "(the file is too large to show which lines changed)\n"
+	if info.Size() > fileStateMaxContent {
+		// there's no showing what changed, so don't read it all in.
+		if st.version == "" {
+			// read_file only read part of it, so there's no telling a
+			// touch from a change.
+			if update {
+				t.set(path, info.Size(), "", nil)
+			}
+			return fileChange{diff: tooLarge}
+		}
+		version, err := fileVersionOf(path)
+		if err != nil {
+			return fileChange{}
+		}
+		if update {
+			t.set(path, info.Size(), version, nil)
+		}
+		if version == st.version {
+			return fileChange{}
+		}
+		return fileChange{diff: tooLarge}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fileChange{}
+	}
+	if update {
+		t.record(path, data)
+	}
+	switch {
+	case fileVersion(data) == st.version:
+		// only touched.
+		return fileChange{}
+	case st.content == nil:
+		return fileChange{diff: tooLarge}
+	}
+	return fileChange{diff: GenerateDiff(path, string(st.content), string(data))}
+}
+
+type fileTrackerKey struct{}
+
+// WithFileTracker returns a context in which the file tools record what
+// the model reads and writes in t, and check files against it before
+// changing them.
+func WithFileTracker(ctx context.Context, t *FileTracker) context.Context {
+	return context.WithValue(ctx, fileTrackerKey{}, t)
+}
+
+func fileTrackerFromContext(ctx context.Context) *FileTracker {
+	t, _ := ctx.Value(fileTrackerKey{}).(*FileTracker)
+	return t
+}
+
+// recordRead notes that the model has seen data as the content of path,
+// whether by reading or writing it.
+func recordRead(ctx context.Context, path string, data []byte) {
+	if t := fileTrackerFromContext(ctx); t != nil {
+		t.record(path, data)
+	}
+}
+
+// recordReadVersion is like recordRead, for a file too large to hold in
+// memory, given its size and version, which is empty if it isn't known.
+func recordReadVersion(ctx context.Context, path string, size int64, version string) {
+	if t := fileTrackerFromContext(ctx); t != nil {
+		t.set(path, size, version, nil)
+	}
+}
+
+// checkFile compares path with how the model last saw it, returning a
+// fileChange that is empty if there's no tracker.
+func checkFile(ctx context.Context, path string) fileChange {
+	if t := fileTrackerFromContext(ctx); t != nil {
+		return t.check(path, true)
+	}
+	return fileChange{}
+}
+
+// peekFile is checkFile without recording the file's new state, for
+// previews that shouldn't stop the change itself from being reported.
+func peekFile(ctx context.Context, path string) fileChange {
+	if t := fileTrackerFromContext(ctx); t != nil {
+		return t.check(path, false)
+	}
+	return fileChange{}
+}
+
+// warning describes c as a note to add to a mutating tool's result, or
+// returns "" if there's nothing to say.
+func (c fileChange) warning(path string) string {
+	switch {
+	case c.deleted:
+		return fmt.Sprintf("warning: %s was deleted since you last read it\n", path)
+	case c.diff != "":
+		return fmt.Sprintf("warning: %s changed on disk since you last read it, before this edit:\n%s", path, c.diff)
+	case c.unread:
+		return fmt.Sprintf("note: you haven't read %s in this session\n", path)
+	}
+	return ""
+}
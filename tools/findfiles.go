@@ -0,0 +1,194 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/modfin/bellman/tools"
+)
+
+// findMaxEntries bounds how many matches find_files collects before it
+// stops walking.
+const findMaxEntries = 10000
+
+type findFilesArgs struct {
+	Path           string `json:"path,omitempty" json-description:"The directory to search from (default: current directory)"`
+	Name           string `json:"name,omitempty" json-description:"Glob the name must match (e.g. session*.go). A glob containing a slash (e.g. cmd/**/main.go) matches the path relative to path instead."`
+	Regex          string `json:"regex,omitempty" json-description:"Regular expression (Go RE2 syntax) the name must match, e.g. ^session(_test)?\\.go$"`
+	Type           string `json:"type,omitempty" json-description:"Only return entries of this type: file, dir or symlink"`
+	MinSize        int64  `json:"min_size,omitempty" json-description:"Only return files of at least this many bytes"`
+	MaxSize        int64  `json:"max_size,omitempty" json-description:"Only return files of at most this many bytes"`
+	NewerThan      string `json:"newer_than,omitempty" json-description:"Only return entries modified within this long ago, e.g. 90m, 2h or 7d"`
+	OlderThan      string `json:"older_than,omitempty" json-description:"Only return entries last modified longer ago than this, e.g. 30d"`
+	MaxDepth       int    `json:"max_depth,omitempty" json-description:"How many directory levels below path to descend (default: unlimited)"`
+	IncludeIgnored bool   `json:"include_ignored,omitempty" json-description:"Also return entries excluded by .gitignore or .ajentignore"`
+	Offset         int    `json:"offset,omitempty" json-description:"1-indexed entry number to start from (default 1)"`
+	Limit          int    `json:"limit,omitempty" json-description:"Maximum number of entries to return (default 200, max 500)"`
+}
+
+// parseAge parses a duration like time.ParseDuration, also accepting a
+// number of days such as "7d".
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+var FindFilesTool = tools.NewTool("find_files",
+	tools.WithDescription("Find files and directories under a path by name (glob or regular expression), type, size and modification time. Skips .git and entries excluded by .gitignore or .ajentignore. Returns one path per line, with a trailing / for directories. Use offset and limit to paginate (default 200 entries, max 500)."),
+	tools.WithArgSchema(findFilesArgs{}),
+	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		var params findFilesArgs
+		if err := json.Unmarshal(call.Argument, &params); err != nil {
+			return fmt.Sprintf("error: invalid arguments: %v", err), nil
+		}
+		if params.Path == "" {
+			params.Path = "."
+		}
+		if params.Offset < 1 {
+			params.Offset = 1
+		}
+		if params.Limit <= 0 {
+			params.Limit = 200
+		}
+		if params.Limit > 500 {
+			params.Limit = 500
+		}
+
+		if params.Name != "" {
+			if _, err := filepath.Match(strings.ReplaceAll(params.Name, "**", "*"), ""); err != nil {
+				return fmt.Sprintf("error: invalid glob %q: %v", params.Name, err), nil
+			}
+		}
+		var re *regexp.Regexp
+		if params.Regex != "" {
+			var err error
+			if re, err = regexp.Compile(params.Regex); err != nil {
+				return fmt.Sprintf("error: invalid regex: %v", err), nil
+			}
+		}
+		var wantType fs.FileMode
+		switch params.Type {
+		case "", "file":
+		case "dir":
+			wantType = fs.ModeDir
+		case "symlink":
+			wantType = fs.ModeSymlink
+		default:
+			return fmt.Sprintf("error: invalid type %q: must be file, dir or symlink", params.Type), nil
+		}
+		now := time.Now()
+		var newerThan, olderThan time.Time
+		if params.NewerThan != "" {
+			age, err := parseAge(params.NewerThan)
+			if err != nil {
+				return fmt.Sprintf("error: newer_than: %v", err), nil
+			}
+			newerThan = now.Add(-age)
+		}
+		if params.OlderThan != "" {
+			age, err := parseAge(params.OlderThan)
+			if err != nil {
+				return fmt.Sprintf("error: older_than: %v", err), nil
+			}
+			olderThan = now.Add(-age)
+		}
+
+		match := func(rel string, d fs.DirEntry) bool {
+			switch {
+			case params.Type == "file" && !d.Type().IsRegular():
+				return false
+			case params.Type != "file" && params.Type != "" && d.Type()&fs.ModeType != wantType:
+				return false
+			case params.Name != "" && !matchesAnyGlob([]string{params.Name}, rel):
+				return false
+			case re != nil && !re.MatchString(d.Name()):
+				return false
+			}
+			if params.MinSize <= 0 && params.MaxSize <= 0 && newerThan.IsZero() && olderThan.IsZero() {
+				return true
+			}
+			info, err := d.Info()
+			if err != nil {
+				return false
+			}
+			if !d.IsDir() && (params.MinSize > 0 && info.Size() < params.MinSize || params.MaxSize > 0 && info.Size() > params.MaxSize) {
+				return false
+			}
+			return (newerThan.IsZero() || !info.ModTime().Before(newerThan)) &&
+				(olderThan.IsZero() || !info.ModTime().After(olderThan))
+		}
+
+		var ignore *ignoreMatcher
+		if !params.IncludeIgnored {
+			ignore = newIgnoreMatcher(params.Path)
+		}
+		root := params.Path
+		var found []string
+		err := walkIgnoring(root, ignore, func(path string, d fs.DirEntry, err error) error {
+			if ctx.Err() != nil || len(found) >= findMaxEntries {
+				return filepath.SkipAll
+			}
+			if path == root {
+				if !d.IsDir() {
+					return fmt.Errorf("%s is not a directory", root)
+				}
+				return nil
+			}
+			rel, _ := filepath.Rel(root, path)
+			if match(rel, d) {
+				if d.IsDir() {
+					found = append(found, path+string(filepath.Separator))
+				} else {
+					found = append(found, path)
+				}
+			}
+			if d.IsDir() && params.MaxDepth > 0 && strings.Count(filepath.ToSlash(rel), "/")+1 >= params.MaxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return fmt.Sprintf("error: %s does not exist", params.Path), nil
+			}
+			return fmt.Sprintf("error: %v", err), nil
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Sprintf("error: %v", err), nil
+		}
+
+		total := len(found)
+		if total == 0 {
+			return "[entries 0-0 of 0]\n(no matches)", nil
+		}
+		if params.Offset > total {
+			return fmt.Sprintf("error: offset %d is beyond the number of entries (%d)", params.Offset, total), nil
+		}
+		endIdx := min(params.Offset-1+params.Limit, total)
+
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "[entries %d-%d of %d]\n", params.Offset, endIdx, total)
+		for _, path := range found[params.Offset-1 : endIdx] {
+			sb.WriteString(path)
+			sb.WriteByte('\n')
+		}
+		if total >= findMaxEntries {
+			fmt.Fprintf(&sb, "... (search stopped after %d entries; narrow it down)\n", findMaxEntries)
+		}
+		return sb.String(), nil
+	}),
+)
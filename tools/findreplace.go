@@ -17,7 +17,7 @@ type findReplaceArgs struct {
 }
 
 var FindReplaceTool = tools.NewTool("find_replace",
-	tools.WithDescription("Content-based find and replace in a file. The old_text must appear exactly once in the file. No hashline references needed."),
+	tools.WithDescription("Content-based find and replace in a file. The old_text must appear exactly once in the file. No hashline references needed. If old_text isn't found exactly, whole lines are matched ignoring trailing whitespace, then ignoring indentation (re-indenting new_text to match), as long as the match is still unique; the result says when this happened. Refuses to change a file that changed on disk since you last read it, showing what changed."),
 	tools.WithArgSchema(findReplaceArgs{}),
 	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
 		var params findReplaceArgs
@@ -31,33 +31,166 @@ var FindReplaceTool = tools.NewTool("find_replace",
 			return "error: old_text is required", nil
 		}
 
+		change := checkFile(ctx, params.Path)
+		if change.diff != "" {
+			return fmt.Sprintf("error: %s changed on disk since you last read it:\n%sNo changes were made. Check that old_text and new_text still fit the new content, then try again.", params.Path, change.diff), nil
+		}
 		data, err := os.ReadFile(params.Path)
 		if err != nil {
 			return fmt.Sprintf("error: %v", err), nil
 		}
 		content := string(data)
 
-		count := strings.Count(content, params.OldText)
-		if count == 0 {
-			return fmt.Sprintf("error: old_text not found in %s", params.Path), nil
-		}
-		if count > 1 {
+		var newContent, note string
+		switch count := strings.Count(content, params.OldText); {
+		case count == 1:
+			newContent = strings.Replace(content, params.OldText, params.NewText, 1)
+		case count > 1:
 			return fmt.Sprintf("error: found %d occurrences of old_text in %s, provide more surrounding context to uniquely identify the target", count, params.Path), nil
+		default:
+			m, count, level := fuzzyFind(content, params.OldText)
+			if count == 0 {
+				return fmt.Sprintf("error: old_text not found in %s", params.Path), nil
+			}
+			if count > 1 {
+				return fmt.Sprintf("error: old_text not found exactly, and found %d occurrences %s in %s, provide more surrounding context to uniquely identify the target", count, level, params.Path), nil
+			}
+			newContent = m.replace(params.NewText)
+			matched := fmt.Sprintf("lines %d-%d", m.start+1, m.end)
+			if m.end == m.start+1 {
+				matched = fmt.Sprintf("line %d", m.end)
+			}
+			note = fmt.Sprintf("\nnote: old_text was not found exactly; matched %s %s", matched, level)
+			if m.reindent {
+				note += ", and new_text was re-indented to match"
+			}
 		}
 
-		newContent := strings.Replace(content, params.OldText, params.NewText, 1)
-
-		info, err := os.Stat(params.Path)
-		if err != nil {
+		if err := snapshot(ctx, call, params.Path); err != nil {
 			return fmt.Sprintf("error: %v", err), nil
 		}
-		if err := os.WriteFile(params.Path, []byte(newContent), info.Mode().Perm()); err != nil {
+		if err := writeFileAtomic(params.Path, []byte(newContent), 0644, followSymlinks); err != nil {
 			return fmt.Sprintf("error writing file: %v", err), nil
 		}
+		recordRead(ctx, params.Path, []byte(newContent))
 
 		newLines := strings.Count(newContent, "\n")
 		diff := GenerateDiff(params.Path, content, newContent)
-		return fmt.Sprintf("ok: replaced text in %s (%d lines)\n\n%s", params.Path, newLines+1, diff), nil
-		
+		return fmt.Sprintf("ok: replaced text in %s (%d lines)%s\n%s\n%s", params.Path, newLines+1, note, change.warning(params.Path), diff), nil
 	}),
 )
+
+// fuzzyMatch is a block of whole lines that matched old_text after
+// normalizing whitespace.
+type fuzzyMatch struct {
+	lines      []string // the file's lines
+	start, end int      // the matched lines, 0-indexed, end exclusive
+	oldLines   []string
+	reindent   bool
+}
+
+// fuzzyLevels are the relaxed comparisons find_replace falls back to, in
+// order, when old_text isn't found exactly.
+var fuzzyLevels = []struct {
+	name      string
+	normalize func(string) string
+	reindent  bool
+}{
+	{"ignoring trailing whitespace", func(s string) string { return strings.TrimRight(s, " \t\r") }, false},
+	{"ignoring indentation", strings.TrimSpace, true},
+}
+
+// fuzzyFind looks for old as a block of whole lines in content at each of
+// fuzzyLevels, stopping at the first level with any matches. It returns
+// the first match, how many there were and the level's name.
+func fuzzyFind(content, old string) (fuzzyMatch, int, string) {
+	lines := strings.Split(content, "\n")
+	n := len(lines)
+	if strings.HasSuffix(content, "\n") {
+		n-- // the empty string after the final newline isn't a line
+	}
+	oldLines := strings.Split(strings.TrimSuffix(old, "\n"), "\n")
+	if strings.TrimSpace(old) == "" || len(oldLines) > n {
+		return fuzzyMatch{}, 0, ""
+	}
+
+	for _, level := range fuzzyLevels {
+		var first fuzzyMatch
+		count := 0
+		for i := 0; i+len(oldLines) <= n; i++ {
+			matched := true
+			for j, oldLine := range oldLines {
+				if level.normalize(lines[i+j]) != level.normalize(oldLine) {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				if count == 0 {
+					first = fuzzyMatch{lines: lines, start: i, end: i + len(oldLines), oldLines: oldLines, reindent: level.reindent}
+				}
+				count++
+			}
+		}
+		if count > 0 {
+			return first, count, level.name
+		}
+	}
+	return fuzzyMatch{}, 0, ""
+}
+
+// replace returns the file's content with the matched lines replaced by
+// newText, re-indented if the match ignored indentation.
+func (m fuzzyMatch) replace(newText string) string {
+	var newLines []string
+	if newText != "" {
+		newLines = strings.Split(strings.TrimSuffix(newText, "\n"), "\n")
+	}
+	if m.reindent {
+		newLines = reindent(newLines, m.oldLines, m.lines[m.start:m.end])
+	}
+	result := make([]string, 0, len(m.lines)-(m.end-m.start)+len(newLines))
+	result = append(result, m.lines[:m.start]...)
+	result = append(result, newLines...)
+	result = append(result, m.lines[m.end:]...)
+	return strings.Join(result, "\n")
+}
+
+// reindent rewrites the indentation of newLines, which were written to
+// replace oldLines, to match how the file actually indents them
+// (matchedLines). Each line's indentation is mapped to the file's
+// indentation for the longest old indentation it starts with.
+func reindent(newLines, oldLines, matchedLines []string) []string {
+	indents := map[string]string{}
+	for i, oldLine := range oldLines {
+		if strings.TrimSpace(oldLine) == "" {
+			continue
+		}
+		old := leadingWhitespace(oldLine)
+		if _, ok := indents[old]; !ok {
+			indents[old] = leadingWhitespace(matchedLines[i])
+		}
+	}
+
+	result := make([]string, len(newLines))
+	for i, line := range newLines {
+		result[i] = line
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := leadingWhitespace(line)
+		best := -1
+		for old := range indents {
+			if strings.HasPrefix(indent, old) && len(old) > best {
+				best = len(old)
+				result[i] = indents[old] + line[len(old):]
+			}
+		}
+	}
+	return result
+}
+
+// leadingWhitespace returns the spaces and tabs line starts with.
+func leadingWhitespace(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
@@ -0,0 +1,92 @@
+package tools
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// hasGlobMeta reports whether pattern contains any glob metacharacters.
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// matchGlob reports whether name matches pattern. Patterns use
+// filepath.Match syntax within each path segment, plus ** to match any
+// number of segments (including none).
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(filepath.ToSlash(pattern), "/"), strings.Split(filepath.ToSlash(name), "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := filepath.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// expandGlob returns the paths matching pattern, in lexical order. See
+// matchGlob for the pattern syntax. A pattern without metacharacters
+// matches itself, whether or not it exists. Walking for ** skips .git
+// directories.
+func expandGlob(pattern string) ([]string, error) {
+	if !hasGlobMeta(pattern) {
+		return []string{pattern}, nil
+	}
+	if !strings.Contains(pattern, "**") {
+		return filepath.Glob(pattern)
+	}
+
+	// walk from the deepest directory that has no metacharacters.
+	pattern = filepath.Clean(pattern)
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	fixed := 0
+	for fixed < len(segments) && !hasGlobMeta(segments[fixed]) {
+		fixed++
+	}
+	root := filepath.FromSlash(strings.Join(segments[:fixed], "/"))
+	if root == "" {
+		root = "."
+		if strings.HasPrefix(pattern, "/") {
+			root = "/"
+		}
+	}
+
+	var matches []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if matchGlob(pattern, path) {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
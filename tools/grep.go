@@ -0,0 +1,185 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/modfin/bellman/tools"
+)
+
+const (
+	// grepMaxFileSize is the size above which grep skips a file.
+	grepMaxFileSize = 4 * 1024 * 1024
+	// grepSniffSize is how much of a file is checked for NUL bytes to
+	// decide whether it is binary.
+	grepSniffSize = 8000
+)
+
+type grepArgs struct {
+	Pattern         string   `json:"pattern" json-description:"The regular expression (Go RE2 syntax) to search for"`
+	Path            string   `json:"path,omitempty" json-description:"The directory (or file) to search (default: current directory)"`
+	Include         []string `json:"include,omitempty" json-description:"Only search files matching one of these globs (e.g. *.go, src/**/*.ts). Globs without a slash match file names; others match paths relative to path."`
+	Exclude         []string `json:"exclude,omitempty" json-description:"Skip files and directories matching one of these globs, with the same syntax as include"`
+	CaseInsensitive bool     `json:"case_insensitive,omitempty" json-description:"Match case-insensitively"`
+	Literal         bool     `json:"literal,omitempty" json-description:"Treat pattern as a literal string rather than a regular expression"`
+	ContextLines    int      `json:"context_lines,omitempty" json-description:"Number of lines to show before and after each match (default 0)"`
+	IncludeIgnored  bool     `json:"include_ignored,omitempty" json-description:"Also search files excluded by .gitignore or .ajentignore"`
+}
+
+var GrepTool = tools.NewTool("grep",
+	tools.WithDescription("Search a directory tree for lines matching a regular expression. Skips .git, binary files and files excluded by .gitignore or .ajentignore. Returns matching lines grouped by file in hashline format ('line:hash|content', usable with edit_file). Use include/exclude globs to narrow the search and context_lines to show surrounding lines. Output is capped at 100 matches across all files, and lines over 2000 bytes are cut off with a marker."),
+	tools.WithArgSchema(grepArgs{}),
+	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		var params grepArgs
+		if err := json.Unmarshal(call.Argument, &params); err != nil {
+			return fmt.Sprintf("error: invalid arguments: %v", err), nil
+		}
+		if params.Pattern == "" {
+			return "error: pattern is required", nil
+		}
+		if params.Path == "" {
+			params.Path = "."
+		}
+		expr := params.Pattern
+		if params.Literal {
+			expr = regexp.QuoteMeta(expr)
+		}
+		if params.CaseInsensitive {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Sprintf("error: invalid pattern: %v", err), nil
+		}
+		for _, pattern := range append(append([]string{}, params.Include...), params.Exclude...) {
+			if _, err := filepath.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+				return fmt.Sprintf("error: invalid glob %q: %v", pattern, err), nil
+			}
+		}
+
+		var ignore *ignoreMatcher
+		if !params.IncludeIgnored {
+			ignore = newIgnoreMatcher(params.Path)
+		}
+		var sb strings.Builder
+		matches, files, binary := 0, 0, 0
+		searchFile := func(path string) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return
+			}
+			if bytes.IndexByte(data[:min(len(data), grepSniffSize)], 0) >= 0 {
+				binary++
+				return
+			}
+			lines, _ := splitLines(string(data))
+			var matchIndices []int
+			for i, line := range lines {
+				if matches+len(matchIndices) >= grepMaxMatches {
+					break
+				}
+				if re.MatchString(line) {
+					matchIndices = append(matchIndices, i)
+				}
+			}
+			if len(matchIndices) == 0 {
+				return
+			}
+			if files > 0 {
+				sb.WriteByte('\n')
+			}
+			fmt.Fprintf(&sb, "==> %s <==\n", path)
+			recordRead(ctx, path, data)
+			sb.WriteString(formatMatches(lines, matchIndices, params.ContextLines, hashWidthFromContext(ctx)))
+			matches += len(matchIndices)
+			files++
+		}
+
+		root := params.Path
+		err = walkIgnoring(root, ignore, func(path string, d fs.DirEntry, err error) error {
+			if matches >= grepMaxMatches || ctx.Err() != nil {
+				return filepath.SkipAll
+			}
+			if path == root {
+				if !d.IsDir() {
+					searchFile(path)
+				}
+				return nil
+			}
+			rel, _ := filepath.Rel(root, path)
+			if matchesAnyGlob(params.Exclude, rel) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			if len(params.Include) > 0 && !matchesAnyGlob(params.Include, rel) {
+				return nil
+			}
+			if info, err := d.Info(); err != nil || info.Size() > grepMaxFileSize {
+				return nil
+			}
+			searchFile(path)
+			return nil
+		})
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return fmt.Sprintf("error: %s does not exist", params.Path), nil
+			}
+			return fmt.Sprintf("error: %v", err), nil
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Sprintf("error: %v", err), nil
+		}
+
+		if matches == 0 {
+			result := fmt.Sprintf("no matches for %q in %s", params.Pattern, params.Path)
+			if binary > 0 {
+				result += fmt.Sprintf(" (%d binary files skipped)", binary)
+			}
+			return result, nil
+		}
+		result := fmt.Sprintf("%d match", matches)
+		if matches != 1 {
+			result += "es"
+		}
+		result += fmt.Sprintf(" in %d file", files)
+		if files != 1 {
+			result += "s"
+		}
+		result += ":\n" + sb.String()
+		if matches >= grepMaxMatches {
+			result += fmt.Sprintf("... (output truncated at %d matches)\n", grepMaxMatches)
+		}
+		return result, nil
+	}),
+)
+
+// matchesAnyGlob reports whether the slash-separated path rel matches any
+// of patterns. A pattern without a slash is matched against the last
+// element of rel only.
+func matchesAnyGlob(patterns []string, rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(filepath.ToSlash(pattern), "./")
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = rel[strings.LastIndex(rel, "/")+1:]
+		}
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
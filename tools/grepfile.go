@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/modfin/bellman/tools"
@@ -18,7 +19,7 @@ type grepFileArgs struct {
 }
 
 var GrepFileTool = tools.NewTool("grep_file",
-	tools.WithDescription("Search a file for lines containing a substring. Returns matching lines in hashline format. Use context_lines to show surrounding context. Output is capped at 100 matches."),
+	tools.WithDescription("Search a file for lines containing a substring. Returns matching lines in hashline format. Use context_lines to show surrounding context. Output is capped at 100 matches, and lines over 2000 bytes are cut off with a marker."),
 	tools.WithArgSchema(grepFileArgs{}),
 	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
 		var params grepFileArgs
@@ -32,10 +33,12 @@ var GrepFileTool = tools.NewTool("grep_file",
 			return "error: query is required", nil
 		}
 
-		lines, _, err := readFileLines(params.Path)
+		data, err := os.ReadFile(params.Path)
 		if err != nil {
 			return fmt.Sprintf("error: %v", err), nil
 		}
+		lines, _ := splitLines(string(data))
+		recordRead(ctx, params.Path, data)
 
 		// Find all matching line indices (0-indexed)
 		var matchIndices []int
@@ -52,70 +55,78 @@ var GrepFileTool = tools.NewTool("grep_file",
 			return fmt.Sprintf("no matches for %q in %s", params.Query, params.Path), nil
 		}
 
-		var sb strings.Builder
-
-		if params.ContextLines <= 0 {
-			// No context: simple output
-			for _, idx := range matchIndices {
-				lineNum := idx + 1
-				hash := hashLineContent(lines[idx])
-				fmt.Fprintf(&sb, "%d:%s|%s\n", lineNum, hash, lines[idx])
-			}
-		} else {
-			// Build groups of contiguous ranges (merging overlapping context windows)
-			type lineRange struct {
-				start int // 0-indexed inclusive
-				end   int // 0-indexed inclusive
-			}
-			var groups []lineRange
-			for _, idx := range matchIndices {
-				start := idx - params.ContextLines
-				if start < 0 {
-					start = 0
-				}
-				end := idx + params.ContextLines
-				if end >= len(lines) {
-					end = len(lines) - 1
-				}
-				if len(groups) > 0 && start <= groups[len(groups)-1].end+1 {
-					// Merge with previous group
-					groups[len(groups)-1].end = end
-				} else {
-					groups = append(groups, lineRange{start: start, end: end})
-				}
-			}
-
-			// Build a set of match indices for quick lookup
-			matchSet := make(map[int]bool, len(matchIndices))
-			for _, idx := range matchIndices {
-				matchSet[idx] = true
-			}
-
-			for gi, group := range groups {
-				if gi > 0 {
-					sb.WriteByte('\n')
-				}
-				for i := group.start; i <= group.end; i++ {
-					lineNum := i + 1
-					hash := hashLineContent(lines[i])
-					if matchSet[i] {
-						fmt.Fprintf(&sb, "> %d:%s|%s\n", lineNum, hash, lines[i])
-					} else {
-						fmt.Fprintf(&sb, "  %d:%s|%s\n", lineNum, hash, lines[i])
-					}
-				}
-			}
-		}
-
 		matches := len(matchIndices)
 		result := fmt.Sprintf("%d match", matches)
 		if matches != 1 {
 			result += "es"
 		}
-		result += ":\n" + sb.String()
+		result += ":\n" + formatMatches(lines, matchIndices, params.ContextLines, hashWidthFromContext(ctx))
 		if matches >= grepMaxMatches {
 			result += fmt.Sprintf("... (output truncated at %d matches)\n", grepMaxMatches)
 		}
 		return result, nil
 	}),
 )
+
+// formatMatches renders the 0-indexed matchIndices of lines in hashline
+// format, with hashes width hex digits wide and long lines cut off by
+// capLine. With contextLines, each match is shown with that many lines
+// around it, prefixed with "> ", overlapping windows are merged and
+// separate groups are divided by a blank line.
+func formatMatches(lines []string, matchIndices []int, contextLines, width int) string {
+	var sb strings.Builder
+
+	if contextLines <= 0 {
+		// No context: simple output
+		for _, idx := range matchIndices {
+			lineNum := idx + 1
+			hash := hashLine(lines[idx], width)
+			fmt.Fprintf(&sb, "%d:%s|%s\n", lineNum, hash, capLine(lines[idx], len(lines[idx])))
+		}
+	} else {
+		// Build groups of contiguous ranges (merging overlapping context windows)
+		type lineRange struct {
+			start int // 0-indexed inclusive
+			end   int // 0-indexed inclusive
+		}
+		var groups []lineRange
+		for _, idx := range matchIndices {
+			start := idx - contextLines
+			if start < 0 {
+				start = 0
+			}
+			end := idx + contextLines
+			if end >= len(lines) {
+				end = len(lines) - 1
+			}
+			if len(groups) > 0 && start <= groups[len(groups)-1].end+1 {
+				// Merge with previous group
+				groups[len(groups)-1].end = end
+			} else {
+				groups = append(groups, lineRange{start: start, end: end})
+			}
+		}
+
+		// Build a set of match indices for quick lookup
+		matchSet := make(map[int]bool, len(matchIndices))
+		for _, idx := range matchIndices {
+			matchSet[idx] = true
+		}
+
+		for gi, group := range groups {
+			if gi > 0 {
+				sb.WriteByte('\n')
+			}
+			for i := group.start; i <= group.end; i++ {
+				lineNum := i + 1
+				hash := hashLine(lines[i], width)
+				if matchSet[i] {
+					fmt.Fprintf(&sb, "> %d:%s|%s\n", lineNum, hash, capLine(lines[i], len(lines[i])))
+				} else {
+					fmt.Fprintf(&sb, "  %d:%s|%s\n", lineNum, hash, capLine(lines[i], len(lines[i])))
+				}
+			}
+		}
+	}
+	return sb.String()
+}
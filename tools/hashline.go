@@ -1,18 +1,89 @@
 package tools
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"os"
 	"strconv"
 	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxLineLength is the longest line, in bytes, that hashlines show in
+	// full. Longer lines are cut off with a marker, though their hashes
+	// still cover the whole line.
+	maxLineLength = 2000
+
+	// DefaultHashWidth is how many hex digits the line hashes in hashlines
+	// have unless configured otherwise.
+	DefaultHashWidth = 2
+	// MaxHashWidth is the widest line hash supported.
+	MaxHashWidth = 8
 )
 
 // hashLineContent returns a 2-character hex hash of the line content.
 func hashLineContent(line string) string {
+	return hashLine(line, DefaultHashWidth)
+}
+
+// hashLine returns a width-character hex hash of the line content. A
+// narrower hash is a suffix of a wider one, so references of any width can
+// be checked.
+func hashLine(line string, width int) string {
 	h := fnv.New32a()
 	h.Write([]byte(line))
-	return fmt.Sprintf("%02x", byte(h.Sum32()))
+	return formatLineHash(h.Sum32(), width)
+}
+
+// formatLineHash formats the FNV-32a sum of a line as its width-character
+// hash.
+func formatLineHash(sum uint32, width int) string {
+	hash := fmt.Sprintf("%08x", sum)
+	return hash[len(hash)-width:]
+}
+
+// fileVersion returns a short stamp identifying a file's content, which
+// read_file reports and edit_file can check to make sure no line
+// references are stale, even ones whose line hash happens to still match.
+func fileVersion(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:4])
+}
+
+// fileVersionOf returns the fileVersion of the file at path, without
+// holding all of it in memory.
+func fileVersionOf(path string) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)[:4]), nil
+}
+
+type hashWidthKey struct{}
+
+// WithHashWidth returns a context in which file tools show line hashes
+// width hex digits wide, between DefaultHashWidth and MaxHashWidth.
+func WithHashWidth(ctx context.Context, width int) context.Context {
+	return context.WithValue(ctx, hashWidthKey{}, width)
+}
+
+func hashWidthFromContext(ctx context.Context) int {
+	width, ok := ctx.Value(hashWidthKey{}).(int)
+	if !ok {
+		return DefaultHashWidth
+	}
+	return max(DefaultHashWidth, min(width, MaxHashWidth))
 }
 
 // readFileLines reads a file and returns its lines (without trailing newlines)
@@ -22,30 +93,52 @@ func readFileLines(path string) ([]string, bool, error) {
 	if err != nil {
 		return nil, false, err
 	}
-	content := string(data)
+	lines, endsWithNewline := splitLines(string(data))
+	return lines, endsWithNewline, nil
+}
+
+// splitLines splits file content into lines (without trailing newlines) and
+// reports whether it ended with a newline.
+func splitLines(content string) ([]string, bool) {
 	if content == "" {
-		return nil, false, nil
+		return nil, false
 	}
 	endsWithNewline := strings.HasSuffix(content, "\n")
 	lines := strings.Split(content, "\n")
 	if endsWithNewline && len(lines) > 0 && lines[len(lines)-1] == "" {
 		lines = lines[:len(lines)-1]
 	}
-	return lines, endsWithNewline, nil
+	return lines, endsWithNewline
 }
 
-// formatHashlines formats lines with hashline prefixes.
+// formatHashlines formats lines with hashline prefixes, with hashes width
+// hex digits wide.
 // lineOffset is 0-indexed (the index of the first line in the full file).
-func formatHashlines(lines []string, lineOffset int) string {
+func formatHashlines(lines []string, lineOffset, width int) string {
 	var sb strings.Builder
 	for i, line := range lines {
 		lineNum := lineOffset + i + 1 // 1-indexed
-		hash := hashLineContent(line)
-		fmt.Fprintf(&sb, "%d:%s|%s\n", lineNum, hash, line)
+		hash := hashLine(line, width)
+		fmt.Fprintf(&sb, "%d:%s|%s\n", lineNum, hash, capLine(line, len(line)))
 	}
 	return sb.String()
 }
 
+// capLine returns the start of a line that is size bytes long in full, cut
+// off at maxLineLength with a marker saying how much is missing. start may
+// be the whole line or, if the rest wasn't kept, just enough of it to cut
+// at a character boundary: maxLineLength+utf8.UTFMax bytes.
+func capLine(start string, size int) string {
+	if size <= maxLineLength {
+		return start
+	}
+	cut := min(maxLineLength, len(start))
+	for cut > 0 && cut < len(start) && !utf8.RuneStart(start[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s[... line truncated, %s more bytes]", start[:cut], formatCount(size-cut))
+}
+
 // parseHashlineRef parses a hashline reference like "5:a3" into line number and hash.
 func parseHashlineRef(ref string) (lineNum int, hash string, err error) {
 	parts := strings.SplitN(ref, ":", 2)
@@ -63,11 +156,16 @@ func parseHashlineRef(ref string) (lineNum int, hash string, err error) {
 }
 
 // validateHashlineRef checks that the line at lineNum (1-indexed) has the expected hash.
+// The hash may be any width from DefaultHashWidth to MaxHashWidth; a
+// narrower one would match a changed line too often to be worth checking.
 func validateHashlineRef(lines []string, lineNum int, expectedHash string) error {
+	if len(expectedHash) < DefaultHashWidth || len(expectedHash) > MaxHashWidth {
+		return fmt.Errorf("invalid hash %q: expected %d to %d hex digits", expectedHash, DefaultHashWidth, MaxHashWidth)
+	}
 	if lineNum > len(lines) {
 		return fmt.Errorf("line %d does not exist (file has %d lines)", lineNum, len(lines))
 	}
-	actualHash := hashLineContent(lines[lineNum-1])
+	actualHash := hashLine(lines[lineNum-1], len(expectedHash))
 	if actualHash != expectedHash {
 		return fmt.Errorf("hash mismatch at line %d: expected %s, got %s (file has changed since last read)", lineNum, expectedHash, actualHash)
 	}
@@ -0,0 +1,219 @@
+package tools
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ignoreRule is a single pattern from a .gitignore file.
+type ignoreRule struct {
+	base     string // absolute, slash-separated directory the rule is relative to
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool // pattern is matched against the whole path under base, not just the name
+}
+
+// ajentIgnoreFile is an ignore file with .gitignore syntax for paths ajent
+// should skip but git shouldn't. Its rules take precedence over the
+// .gitignore in the same directory.
+const ajentIgnoreFile = ".ajentignore"
+
+// ignoreMatcher decides which paths .gitignore and .ajentignore files
+// exclude. Rules are added as directories are visited, so a tree walk
+// should call loadDir on each directory it enters. Later rules take
+// precedence, which gives deeper ignore files precedence over shallower
+// ones.
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+// newIgnoreMatcher returns a matcher for a walk starting at root, with the
+// rules from the ignore files in root's ancestors, up to the top of the
+// enclosing git repository, already loaded.
+func newIgnoreMatcher(root string) *ignoreMatcher {
+	m := &ignoreMatcher{}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return m
+	}
+	var ancestors []string
+	for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+		ancestors = append(ancestors, dir)
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			break
+		}
+		if dir == filepath.Dir(dir) {
+			// not in a git repository, so only root's own rules apply.
+			ancestors = nil
+			break
+		}
+	}
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		m.loadDir(ancestors[i])
+	}
+	return m
+}
+
+// loadDir adds the rules from dir's .gitignore and .ajentignore files, if
+// it has them.
+func (m *ignoreMatcher) loadDir(dir string) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	m.loadFile(abs, filepath.Join(abs, ".gitignore"))
+	m.loadFile(abs, filepath.Join(abs, ajentIgnoreFile))
+}
+
+// loadFile adds the rules from the ignore file at path, relative to the
+// absolute directory base.
+func (m *ignoreMatcher) loadFile(base, path string) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(filepath.ToSlash(base), scanner.Text()); ok {
+			m.rules = append(m.rules, rule)
+		}
+	}
+}
+
+func parseIgnoreRule(base, line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	line = strings.TrimPrefix(line, `\`)
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	rule.pattern = line
+	return rule, true
+}
+
+// ignored reports whether the file or directory at path is excluded. path
+// is assumed to be inside a directory that isn't itself excluded.
+func (m *ignoreMatcher) ignored(p string, isDir bool) bool {
+	if len(m.rules) == 0 {
+		return false
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+	abs = filepath.ToSlash(abs)
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel, ok := strings.CutPrefix(abs, strings.TrimSuffix(rule.base, "/")+"/")
+		if !ok {
+			continue
+		}
+		name := rel
+		if !rule.anchored {
+			name = path.Base(rel)
+		}
+		if matchGlob(rule.pattern, name) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// walkIgnoring walks root like filepath.WalkDir, skipping .git directories
+// and, if ignore isn't nil, everything it excludes. Errors reading entries
+// below root are skipped rather than passed to fn.
+func walkIgnoring(root string, ignore *ignoreMatcher, fn fs.WalkDirFunc) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if path != root {
+			if d.IsDir() && d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if ignore != nil && ignore.ignored(path, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if d.IsDir() && ignore != nil {
+			ignore.loadDir(path)
+		}
+		return fn(path, d, nil)
+	})
+}
+
+// ignoredCountMax bounds how many entries ignoredDirSummary counts.
+const ignoredCountMax = 100000
+
+// ignoredDirSummary describes an ignored directory in place of its
+// contents, e.g. "node_modules/ (12,345 entries, ignored)".
+func ignoredDirSummary(name, path string) string {
+	n := 0
+	_ = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if p == path {
+			return nil
+		}
+		if n++; n >= ignoredCountMax {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	count := formatCount(n)
+	if n >= ignoredCountMax {
+		count += "+"
+	}
+	entries := "entries"
+	if n == 1 {
+		entries = "entry"
+	}
+	return fmt.Sprintf("%s/ (%s %s, ignored)", name, count, entries)
+}
+
+// ignoredFilesSummary describes n ignored files left out of a listing.
+func ignoredFilesSummary(n int) string {
+	if n == 1 {
+		return "(1 ignored file)"
+	}
+	return fmt.Sprintf("(%s ignored files)", formatCount(n))
+}
+
+// formatCount formats n with thousands separators.
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
@@ -0,0 +1,391 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/modfin/bellman/tools"
+)
+
+const (
+	// jobMaxBuffer bounds how much unread output a background job keeps.
+	jobMaxBuffer = 1024 * 1024
+	// jobKeepHead is how much of the start of its unread output a job
+	// keeps when it has to drop some, since that's usually where the first
+	// errors are.
+	jobKeepHead = jobMaxBuffer / 4
+	// jobPollInterval is how often bash_output checks for news while
+	// waiting.
+	jobPollInterval = 100 * time.Millisecond
+	// jobKillGrace is how long a job has to exit after SIGTERM before it
+	// gets SIGKILL.
+	jobKillGrace = 2 * time.Second
+)
+
+// job is a bash command running in the background.
+type job struct {
+	id      string
+	command string
+	started time.Time
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	done    chan struct{}
+
+	mu      sync.Mutex
+	output  []byte // output not yet returned by bash_output
+	dropped int    // bytes dropped from output after jobKeepHead because nobody read them
+	waitErr error  // set once done is closed
+}
+
+func (j *job) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.output = append(j.output, p...)
+	if over := len(j.output) - jobMaxBuffer; over > 0 {
+		j.output = append(j.output[:jobKeepHead], j.output[jobKeepHead+over:]...)
+		j.dropped += over
+	}
+	return len(p), nil
+}
+
+// read returns and clears the job's unread output.
+func (j *job) read() (output []byte, dropped int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	output, dropped = j.output, j.dropped
+	j.output, j.dropped = nil, 0
+	return output, dropped
+}
+
+// formatOutput reads the job's unread output and renders it for the model
+// after a status line. Long output keeps its head and tail, as bash's does,
+// and is saved in full to a scratch file.
+func (j *job) formatOutput(ctx context.Context, cfg BashConfig) string {
+	output, dropped := j.read()
+	if dropped > 0 {
+		var marked bytes.Buffer
+		marked.Write(output[:jobKeepHead])
+		if output[jobKeepHead-1] != '\n' {
+			marked.WriteByte('\n')
+		}
+		fmt.Fprintf(&marked, "[... %d bytes dropped because they weren't read in time ...]\n", dropped)
+		marked.Write(output[jobKeepHead:])
+		output = marked.Bytes()
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "[%s %s]\n", j.id, j.status())
+	if len(output) > cfg.OutputHead+cfg.OutputTail {
+		fmt.Fprintf(&sb, "output: %d bytes (truncated)\n", len(output))
+		writeFullOutput(ctx, &sb, "job", output)
+		output = truncateMiddle(output, cfg.OutputHead, cfg.OutputTail)
+	}
+	sb.Write(output)
+	return sb.String()
+}
+
+func (j *job) pending() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.output) > 0
+}
+
+// status describes whether the job is still running or how it exited.
+func (j *job) status() string {
+	select {
+	case <-j.done:
+	default:
+		return fmt.Sprintf("running for %s", time.Since(j.started).Round(time.Second))
+	}
+	if j.waitErr != nil {
+		return fmt.Sprintf("exited: %v", j.waitErr)
+	}
+	return "exited: exit status 0"
+}
+
+// kill stops the job's whole process group, escalating from SIGTERM to
+// SIGKILL if it doesn't exit promptly.
+func (j *job) kill() {
+	select {
+	case <-j.done:
+		return
+	default:
+	}
+	_ = signalProcessGroup(j.cmd, syscall.SIGTERM)
+	select {
+	case <-j.done:
+	case <-time.After(jobKillGrace):
+		_ = signalProcessGroup(j.cmd, syscall.SIGKILL)
+		<-j.done
+	}
+}
+
+// Jobs tracks the background bash commands started during a session.
+type Jobs struct {
+	mu     sync.Mutex
+	nextID int
+	jobs   map[string]*job
+}
+
+// NewJobs returns an empty set of background jobs.
+func NewJobs() *Jobs {
+	return &Jobs{jobs: map[string]*job{}}
+}
+
+// start runs command in the background, in dir if it isn't empty and with
+// the given environment, and returns its job. stdin is written to the job's
+// stdin, which is left open, before start returns, so nothing written with
+// bash_stdin can get mixed into it. Cancelling ctx while the job isn't
+// reading its stdin kills the job.
+func (js *Jobs) start(ctx context.Context, command, dir string, env []string, stdin string) (*job, error) {
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = env
+	setProcessGroup(cmd)
+	// don't wait forever on children that outlive the job while holding
+	// its output open.
+	cmd.WaitDelay = time.Second
+	stdinPipe, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	j := &job{command: command, cmd: cmd, stdin: stdinPipe, done: make(chan struct{})}
+	cmd.Stdout = j
+	cmd.Stderr = j
+
+	js.mu.Lock()
+	if js.jobs == nil {
+		js.mu.Unlock()
+		return nil, errors.New("session is closed")
+	}
+	if err := cmd.Start(); err != nil {
+		js.mu.Unlock()
+		return nil, err
+	}
+	js.nextID++
+	j.id = fmt.Sprintf("job-%d", js.nextID)
+	j.started = time.Now()
+	js.jobs[j.id] = j
+	js.mu.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		j.mu.Lock()
+		j.waitErr = err
+		j.mu.Unlock()
+		close(j.done)
+	}()
+
+	if stdin != "" {
+		written := make(chan struct{})
+		go func() {
+			_, _ = io.WriteString(j.stdin, stdin)
+			close(written)
+		}()
+		// a job that exits without reading it all closes the pipe, which
+		// ends the write.
+		select {
+		case <-written:
+		case <-ctx.Done():
+			j.kill()
+			return nil, fmt.Errorf("%s was killed while waiting for it to read its stdin: %w", j.id, context.Cause(ctx))
+		}
+	}
+	return j, nil
+}
+
+func (js *Jobs) get(id string) (*job, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	j, ok := js.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown job %q", id)
+	}
+	return j, nil
+}
+
+// list describes every job, in the order they were started.
+func (js *Jobs) list() string {
+	js.mu.Lock()
+	all := make([]*job, 0, len(js.jobs))
+	for _, j := range js.jobs {
+		all = append(all, j)
+	}
+	js.mu.Unlock()
+	if len(all) == 0 {
+		return "No background jobs."
+	}
+	sort.Slice(all, func(a, b int) bool { return all[a].started.Before(all[b].started) })
+	var sb strings.Builder
+	for _, j := range all {
+		fmt.Fprintf(&sb, "%s: %s (%s)\n", j.id, j.command, j.status())
+	}
+	return sb.String()
+}
+
+// Close kills every job that is still running. Jobs can't be started
+// afterwards.
+func (js *Jobs) Close() error {
+	js.mu.Lock()
+	all := js.jobs
+	js.jobs = nil
+	js.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, j := range all {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			j.kill()
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+type jobsKey struct{}
+
+// WithJobs returns a context in which bash can start background jobs,
+// tracked in js, and the job tools can manage them.
+func WithJobs(ctx context.Context, js *Jobs) context.Context {
+	return context.WithValue(ctx, jobsKey{}, js)
+}
+
+func jobsFromContext(ctx context.Context) *Jobs {
+	js, _ := ctx.Value(jobsKey{}).(*Jobs)
+	return js
+}
+
+// lookupJob finds the job for a tool call, returning an error message for
+// the model if there isn't one.
+func lookupJob(ctx context.Context, id string) (*job, string) {
+	js := jobsFromContext(ctx)
+	if js == nil {
+		return nil, "error: background jobs are not available in this session"
+	}
+	if id == "" {
+		return nil, "error: job_id is required"
+	}
+	j, err := js.get(id)
+	if err != nil {
+		return nil, fmt.Sprintf("error: %v\n%s", err, js.list())
+	}
+	return j, ""
+}
+
+type bashOutputArgs struct {
+	JobID string `json:"job_id,omitempty" json-description:"The job ID returned by bash with background set. If omitted, lists all jobs."`
+	Wait  int    `json:"wait,omitempty" json-description:"Seconds to wait for new output or for the job to exit, if there is none yet (default 0)"`
+}
+
+type bashStdinArgs struct {
+	JobID string `json:"job_id" json-description:"The job ID returned by bash with background set"`
+	Input string `json:"input" json-description:"Text to write to the job's stdin. Include a trailing newline to send a complete line."`
+	Close bool   `json:"close,omitempty" json-description:"Close the job's stdin after writing input"`
+}
+
+type bashKillArgs struct {
+	JobID string `json:"job_id" json-description:"The job ID returned by bash with background set"`
+}
+
+// NewBashOutputTool returns the bash_output tool. cfg.MaxTimeout bounds how
+// long a single call may wait for output, and long output is truncated as
+// the bash tool would.
+func NewBashOutputTool(cfg BashConfig) tools.Tool {
+	cfg = cfg.withDefaults()
+	return tools.NewTool("bash_output",
+		tools.WithDescription("Get the output a background bash job has produced since the last call, and whether it is still running. With no job_id, lists all background jobs."),
+		tools.WithArgSchema(bashOutputArgs{}),
+		tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			var params bashOutputArgs
+			if err := json.Unmarshal(call.Argument, &params); err != nil {
+				return fmt.Sprintf("error: invalid arguments: %v", err), nil
+			}
+			if js := jobsFromContext(ctx); js != nil && params.JobID == "" {
+				return js.list(), nil
+			}
+			j, errMsg := lookupJob(ctx, params.JobID)
+			if j == nil {
+				return errMsg, nil
+			}
+
+			wait := min(time.Duration(params.Wait)*time.Second, cfg.MaxTimeout)
+			deadline := time.After(wait)
+			ticker := time.NewTicker(jobPollInterval)
+			defer ticker.Stop()
+		waiting:
+			for !j.pending() {
+				select {
+				case <-j.done:
+					break waiting
+				case <-deadline:
+					break waiting
+				case <-ctx.Done():
+					break waiting
+				case <-ticker.C:
+				}
+			}
+
+			return j.formatOutput(ctx, cfg), nil
+		}),
+	)
+}
+
+var BashStdinTool = tools.NewTool("bash_stdin",
+	tools.WithDescription("Write to the stdin of a background bash job, optionally closing it afterwards."),
+	tools.WithArgSchema(bashStdinArgs{}),
+	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		var params bashStdinArgs
+		if err := json.Unmarshal(call.Argument, &params); err != nil {
+			return fmt.Sprintf("error: invalid arguments: %v", err), nil
+		}
+		j, errMsg := lookupJob(ctx, params.JobID)
+		if j == nil {
+			return errMsg, nil
+		}
+		if _, err := io.WriteString(j.stdin, params.Input); err != nil {
+			return fmt.Sprintf("error: %v (%s)", err, j.status()), nil
+		}
+		if params.Close {
+			if err := j.stdin.Close(); err != nil {
+				return fmt.Sprintf("error: %v", err), nil
+			}
+			return fmt.Sprintf("ok: wrote %d bytes to %s and closed stdin", len(params.Input), j.id), nil
+		}
+		return fmt.Sprintf("ok: wrote %d bytes to %s", len(params.Input), j.id), nil
+	}),
+)
+
+var BashKillTool = NewBashKillTool(BashConfig{})
+
+// NewBashKillTool returns the bash_kill tool, which truncates long output
+// as the bash tool would.
+func NewBashKillTool(cfg BashConfig) tools.Tool {
+	cfg = cfg.withDefaults()
+	return tools.NewTool("bash_kill",
+		tools.WithDescription("Stop a background bash job and any processes it started. Returns its remaining output."),
+		tools.WithArgSchema(bashKillArgs{}),
+		tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			var params bashKillArgs
+			if err := json.Unmarshal(call.Argument, &params); err != nil {
+				return fmt.Sprintf("error: invalid arguments: %v", err), nil
+			}
+			j, errMsg := lookupJob(ctx, params.JobID)
+			if j == nil {
+				return errMsg, nil
+			}
+			j.kill()
+			return j.formatOutput(ctx, cfg), nil
+		}),
+	)
+}
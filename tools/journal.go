@@ -0,0 +1,309 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jtolio/ajent/hjl"
+	"github.com/modfin/bellman/tools"
+)
+
+// JournalEntry is a snapshot of a file taken just before a tool call
+// changed it.
+type JournalEntry struct {
+	CallID  string      `json:"call_id"`
+	Tool    string      `json:"tool"`
+	Path    string      `json:"path"`
+	Time    time.Time   `json:"time"`
+	Existed bool        `json:"existed"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	Content []byte      `json:"content,omitempty"`
+}
+
+// journalRecord is a single journal file entry: either a snapshot or a
+// note that every snapshot from the named call onward was undone.
+type journalRecord struct {
+	Edit *JournalEntry `json:"edit,omitempty"`
+	Undo string        `json:"undo,omitempty"`
+}
+
+// Journal records the content of files before the mutating tools change
+// them, keyed by tool call ID, so those changes can be undone. The journal
+// is kept in an hjl file so it survives restarts.
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	fh      *os.File
+	enc     *hjl.Encoder
+	entries []JournalEntry
+}
+
+// OpenJournal opens the journal at path, creating it if needed. A final
+// record left incomplete by a crash is discarded; a bad record anywhere
+// else is an error.
+func OpenJournal(path string) (*Journal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	j := &Journal{path: path}
+	d := hjl.NewDecoder(bytes.NewReader(data))
+	good := int64(0)
+	for {
+		var r journalRecord
+		if err := d.Decode(&r, "edit.content:base64"); err != nil {
+			if errors.Is(err, io.EOF) && int(good) == len(data) {
+				break
+			}
+			// ajent may have been killed partway through writing the last
+			// record. anything else is real corruption.
+			if !errors.Is(err, io.EOF) && bytes.Contains(data[good:], []byte("\n")) {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			if err := os.Truncate(path, good); err != nil {
+				return nil, err
+			}
+			break
+		}
+		good = d.InputOffset()
+		switch {
+		case r.Edit != nil:
+			j.entries = append(j.entries, *r.Edit)
+		case r.Undo != "":
+			if i := j.index(r.Undo); i >= 0 {
+				j.entries = j.entries[:i]
+			}
+		}
+	}
+
+	j.fh, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j.enc = hjl.NewEncoder(j.fh)
+	return j, nil
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.fh.Close()
+}
+
+// CopyTo copies the journal to path, which must not already exist, and
+// opens the copy.
+func (j *Journal) CopyTo(path string) (*Journal, error) {
+	j.mu.Lock()
+	data, err := os.ReadFile(j.path)
+	j.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fh.Write(data)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	return OpenJournal(path)
+}
+
+// index returns the index of the first entry for callID, or -1.
+func (j *Journal) index(callID string) int {
+	for i, e := range j.entries {
+		if e.CallID == callID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (j *Journal) write(r journalRecord) error {
+	if err := j.enc.Encode(r, "edit.content:base64"); err != nil {
+		return err
+	}
+	return j.fh.Sync()
+}
+
+// Snapshot records the current content of path, if it hasn't already been
+// recorded for callID, which must not be empty.
+func (j *Journal) Snapshot(callID, tool, path string) error {
+	if callID == "" {
+		return errors.New("tool call has no ID")
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, e := range j.entries {
+		if e.CallID == callID && e.Path == abs {
+			return nil
+		}
+	}
+
+	entry := JournalEntry{CallID: callID, Tool: tool, Path: abs, Time: time.Now()}
+	info, err := os.Stat(abs)
+	switch {
+	case err == nil:
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		if entry.Content, err = os.ReadFile(abs); err != nil {
+			return err
+		}
+		entry.Existed = true
+		entry.Mode = info.Mode().Perm()
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	if err := j.write(journalRecord{Edit: &entry}); err != nil {
+		return err
+	}
+	j.entries = append(j.entries, entry)
+	return nil
+}
+
+// Has reports whether any file snapshots were recorded for callID.
+func (j *Journal) Has(callID string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.index(callID) >= 0
+}
+
+// Entries returns the journal's snapshots, oldest first.
+func (j *Journal) Entries() []JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]JournalEntry(nil), j.entries...)
+}
+
+// Undo restores every file changed by callID or any later call to the
+// state it was in just before callID, removes those snapshots from the
+// journal, and returns a description of each restored file.
+func (j *Journal) Undo(callID string) ([]string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	start := j.index(callID)
+	if start < 0 {
+		return nil, fmt.Errorf("no recorded edits for tool call %q", callID)
+	}
+
+	// the earliest snapshot of each path is the state to return to.
+	var restored []string
+	seen := map[string]bool{}
+	for _, e := range j.entries[start:] {
+		if seen[e.Path] {
+			continue
+		}
+		seen[e.Path] = true
+		if !e.Existed {
+			if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+				return restored, err
+			}
+			restored = append(restored, "removed "+e.Path)
+			continue
+		}
+		if err := writeFileAtomic(e.Path, e.Content, e.Mode, followSymlinks); err != nil {
+			return restored, err
+		}
+		if err := os.Chmod(e.Path, e.Mode); err != nil {
+			return restored, err
+		}
+		restored = append(restored, "restored "+e.Path)
+	}
+
+	if err := j.write(journalRecord{Undo: callID}); err != nil {
+		return restored, err
+	}
+	j.entries = j.entries[:start]
+	return restored, nil
+}
+
+type journalKey struct{}
+
+// WithJournal returns a context that makes the mutating tools record their
+// changes in j.
+func WithJournal(ctx context.Context, j *Journal) context.Context {
+	return context.WithValue(ctx, journalKey{}, j)
+}
+
+func journalFromContext(ctx context.Context) *Journal {
+	j, _ := ctx.Value(journalKey{}).(*Journal)
+	return j
+}
+
+// snapshot records path in the context's journal, if any, before call
+// changes it.
+func snapshot(ctx context.Context, call tools.Call, path string) error {
+	j := journalFromContext(ctx)
+	if j == nil {
+		return nil
+	}
+	if err := j.Snapshot(call.ID, call.Name, path); err != nil {
+		return fmt.Errorf("recording undo journal: %w", err)
+	}
+	return nil
+}
+
+type undoEditArgs struct {
+	CallID string `json:"call_id,omitempty" json-description:"The ID of the edit_file, find_replace or create_file tool call to undo. Files changed by that call and every later call are restored to their state before it. If omitted, lists the edits that can be undone."`
+}
+
+var UndoEditTool = tools.NewTool("undo_edit",
+	tools.WithDescription("Undo file changes made by edit_file, find_replace and create_file, restoring files to their state before a given tool call. Call without call_id to list the edits that can be undone."),
+	tools.WithArgSchema(undoEditArgs{}),
+	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		var params undoEditArgs
+		if err := json.Unmarshal(call.Argument, &params); err != nil {
+			return fmt.Sprintf("error: invalid arguments: %v", err), nil
+		}
+		j := journalFromContext(ctx)
+		if j == nil {
+			return "error: no undo journal is available in this session", nil
+		}
+
+		if params.CallID == "" {
+			entries := j.Entries()
+			if len(entries) == 0 {
+				return "No edits to undo.", nil
+			}
+			var sb strings.Builder
+			for _, e := range entries {
+				change := "modified"
+				if !e.Existed {
+					change = "created"
+				}
+				fmt.Fprintf(&sb, "%s %s %s: %s %s\n", e.Time.Format("15:04:05"), e.CallID, e.Tool, change, e.Path)
+			}
+			return sb.String(), nil
+		}
+
+		restored, err := j.Undo(params.CallID)
+		if err != nil {
+			return fmt.Sprintf("error: %v\n%s", err, strings.Join(restored, "\n")), nil
+		}
+		return fmt.Sprintf("ok: undid %s and later edits\n%s", params.CallID, strings.Join(restored, "\n")), nil
+	}),
+)
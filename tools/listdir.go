@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/modfin/bellman/tools"
@@ -14,24 +15,26 @@ type listDirArgs struct {
 	Path   string `json:"path,omitempty" json-description:"The directory path to list. Defaults to the current working directory."`
 	Offset int    `json:"offset,omitempty" json-description:"1-indexed entry number to start from (default 1)"`
 	Limit  int    `json:"limit,omitempty" json-description:"Maximum number of entries to return (default 200, max 500)"`
+
+	IncludeIgnored bool `json:"include_ignored,omitempty" json-description:"If true, list entries excluded by .gitignore or .ajentignore like any others instead of summarizing them. Defaults to false."`
 }
 
 // formatDirEntry formats a single directory entry with permissions, size, mod time, and name.
-func formatDirEntry(path string, entry os.DirEntry) string {
+func formatDirEntry(entry os.DirEntry, name string) string {
 	info, err := entry.Info()
 	if err != nil {
-		return fmt.Sprintf("  ?  %s", entry.Name())
+		return fmt.Sprintf("  ?  %s", name)
 	}
 	return fmt.Sprintf("%s  %10d  %s  %s",
 		info.Mode().String(),
 		info.Size(),
 		info.ModTime().Format("2006-01-02 15:04"),
-		entry.Name(),
+		name,
 	)
 }
 
 var ListDirTool = tools.NewTool("list_directory",
-	tools.WithDescription("List directory contents with details (permissions, size, modification time, name). Use offset and limit to paginate (default 200 entries, max 500)."),
+	tools.WithDescription("List directory contents with details (permissions, size, modification time, name). Directories excluded by .gitignore or .ajentignore are shown with a summary of their entry count, and excluded files are counted on a final line. Use offset and limit to paginate (default 200 entries, max 500)."),
 	tools.WithArgSchema(listDirArgs{}),
 	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
 		var params listDirArgs
@@ -57,7 +60,30 @@ var ListDirTool = tools.NewTool("list_directory",
 			return fmt.Sprintf("error: %v", err), nil
 		}
 
-		totalEntries := len(entries)
+		var ignore *ignoreMatcher
+		if !params.IncludeIgnored {
+			ignore = newIgnoreMatcher(path)
+			ignore.loadDir(path)
+		}
+		var lines []string
+		ignoredFiles := 0
+		for _, entry := range entries {
+			entryPath := filepath.Join(path, entry.Name())
+			if ignore != nil && (entry.IsDir() && entry.Name() == ".git" || ignore.ignored(entryPath, entry.IsDir())) {
+				if entry.IsDir() {
+					lines = append(lines, formatDirEntry(entry, ignoredDirSummary(entry.Name(), entryPath)))
+				} else {
+					ignoredFiles++
+				}
+				continue
+			}
+			lines = append(lines, formatDirEntry(entry, entry.Name()))
+		}
+		if ignoredFiles > 0 {
+			lines = append(lines, ignoredFilesSummary(ignoredFiles))
+		}
+
+		totalEntries := len(lines)
 		if totalEntries == 0 {
 			return "[entries 0-0 of 0]\n(empty directory)", nil
 		}
@@ -74,8 +100,8 @@ var ListDirTool = tools.NewTool("list_directory",
 
 		var sb strings.Builder
 		fmt.Fprintf(&sb, "[entries %d-%d of %d]\n", params.Offset, endIdx, totalEntries)
-		for _, entry := range entries[startIdx:endIdx] {
-			sb.WriteString(formatDirEntry(path, entry))
+		for _, line := range lines[startIdx:endIdx] {
+			sb.WriteString(line)
 			sb.WriteByte('\n')
 		}
 		return sb.String(), nil
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package tools
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup kills cmd. Without process groups, children cmd started
+// are left running, and only SIGKILL is supported.
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
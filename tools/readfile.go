@@ -1,14 +1,36 @@
 package tools
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/modfin/bellman/tools"
 )
 
-const maxReadLines = 200
+const (
+	maxReadLines = 200
+	// readFileStreamSize is the size above which read_file reads a file a
+	// line at a time, keeping only the lines it returns, rather than
+	// loading it whole.
+	readFileStreamSize = 4 * 1024 * 1024
+	// readFileSniffSize is how much of a file read_file checks for NUL
+	// bytes to decide whether it is binary.
+	readFileSniffSize = 8000
+	// binaryPreviewSize is how much of a binary file read_file shows.
+	binaryPreviewSize = 256
+)
 
 type readFileArgs struct {
 	Path      string `json:"path" json-description:"The path to the file to read"`
@@ -16,8 +38,82 @@ type readFileArgs struct {
 	EndLine   int    `json:"end_line,omitempty" json-description:"Last line to return (1-indexed, inclusive, default start_line+199). Max 200 lines per call."`
 }
 
+// scannedLine is a line kept by scanLines: its hash, its length and as
+// much of it as capLine needs.
+type scannedLine struct {
+	sum   uint32
+	size  int
+	start []byte
+}
+
+// scanLines reads r a line at a time, the way splitLines would split it,
+// keeping only lines first through last (1-indexed), and stops after last
+// rather than reading the rest of r. It returns the lines kept and how
+// many lines it read. If it reached the end of r, complete is set and
+// version is r's fileVersion.
+func scanLines(r io.Reader, first, last int) (page []scannedLine, total int, complete bool, version string, err error) {
+	sha := sha256.New()
+	br := bufio.NewReaderSize(io.TeeReader(r, sha), 64*1024)
+	var line scannedLine
+	h := fnv.New32a()
+	partial := false // whether part of line total+1 has been read
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if len(chunk) > 0 {
+			partial = true
+			ended := chunk[len(chunk)-1] == '\n'
+			if ended {
+				chunk = chunk[:len(chunk)-1]
+			}
+			if n := total + 1; n >= first {
+				h.Write(chunk)
+				line.size += len(chunk)
+				if keep := maxLineLength + utf8.UTFMax - len(line.start); keep > 0 {
+					line.start = append(line.start, chunk[:min(keep, len(chunk))]...)
+				}
+			}
+			if ended {
+				if total+1 >= first {
+					line.sum = h.Sum32()
+					page = append(page, line)
+				}
+				total++
+				line, partial = scannedLine{}, false
+				h.Reset()
+				if total == last {
+					if _, err := br.Peek(1); !errors.Is(err, io.EOF) {
+						return page, total, false, "", nil
+					}
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, 0, false, "", err
+		}
+	}
+	if partial {
+		if total+1 >= first {
+			line.sum = h.Sum32()
+			page = append(page, line)
+		}
+		total++
+	}
+	return page, total, true, hex.EncodeToString(sha.Sum(nil)[:4]), nil
+}
+
+// describeBinary summarizes a binary file of the given size, of which head
+// is the start, instead of showing it as lines.
+func describeBinary(size int64, head []byte) string {
+	preview := head[:min(len(head), binaryPreviewSize)]
+	return fmt.Sprintf("[binary file, %s, %s bytes; first %d bytes shown]\n%s",
+		http.DetectContentType(head), formatCount(int(size)), len(preview), hex.Dump(preview))
+}
+
 var ReadFileTool = tools.NewTool("read_file",
-	tools.WithDescription("Read a file with hashline-prefixed lines. Returns up to 200 lines per call. Each line is prefixed with its line number and a content hash in the format 'line:hash|content'. Use the line:hash references with the edit_file tool. Use start_line and end_line to read specific line ranges."),
+	tools.WithDescription("Read a file with hashline-prefixed lines. Returns up to 200 lines per call. Each line is prefixed with its line number and a content hash in the format 'line:hash|content'. Use the line:hash references with the edit_file tool. The header includes the file's version (except for the middle of a very large file), which you can pass to edit_file to make sure the file hasn't changed since. Use start_line and end_line to read specific line ranges. Lines over 2000 bytes are cut off with a marker, though their hashes cover the whole line. Binary files are described by type and size with a hex dump of their start."),
 	tools.WithArgSchema(readFileArgs{}),
 	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
 		var params readFileArgs
@@ -28,14 +124,25 @@ var ReadFileTool = tools.NewTool("read_file",
 			return "error: path is required", nil
 		}
 
-		lines, _, err := readFileLines(params.Path)
+		fh, err := os.Open(params.Path)
 		if err != nil {
 			return fmt.Sprintf("error: %v", err), nil
 		}
-
-		totalLines := len(lines)
-		if totalLines == 0 {
-			return "[lines 0-0 of 0]\n(empty file)", nil
+		defer fh.Close()
+		info, err := fh.Stat()
+		if err != nil {
+			return fmt.Sprintf("error: %v", err), nil
+		}
+		if info.IsDir() {
+			return fmt.Sprintf("error: %s is a directory", params.Path), nil
+		}
+		br := bufio.NewReaderSize(fh, readFileSniffSize)
+		head, err := br.Peek(readFileSniffSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Sprintf("error: %v", err), nil
+		}
+		if bytes.IndexByte(head, 0) >= 0 {
+			return describeBinary(info.Size(), head), nil
 		}
 
 		// Defaults
@@ -51,6 +158,38 @@ var ReadFileTool = tools.NewTool("read_file",
 			params.EndLine = params.StartLine + maxReadLines - 1
 		}
 
+		var content strings.Builder
+		var totalLines int
+		var version string
+		complete := true
+		width := hashWidthFromContext(ctx)
+		if info.Size() > readFileStreamSize {
+			var page []scannedLine
+			page, totalLines, complete, version, err = scanLines(br, params.StartLine, params.EndLine)
+			if err != nil {
+				return fmt.Sprintf("error: %v", err), nil
+			}
+			recordReadVersion(ctx, params.Path, info.Size(), version)
+			for i, line := range page {
+				fmt.Fprintf(&content, "%d:%s|%s\n", params.StartLine+i, formatLineHash(line.sum, width), capLine(string(line.start), line.size))
+			}
+		} else {
+			data, err := io.ReadAll(br)
+			if err != nil {
+				return fmt.Sprintf("error: %v", err), nil
+			}
+			lines, _ := splitLines(string(data))
+			recordRead(ctx, params.Path, data)
+			totalLines, version = len(lines), fileVersion(data)
+			if params.StartLine <= totalLines {
+				content.WriteString(formatHashlines(lines[params.StartLine-1:min(params.EndLine, totalLines)], params.StartLine-1, width))
+			}
+		}
+
+		if totalLines == 0 {
+			return "[lines 0-0 of 0]\n(empty file)", nil
+		}
+
 		// Clamp to file bounds
 		if params.StartLine > totalLines {
 			return fmt.Sprintf("error: start_line %d is beyond end of file (%d lines)", params.StartLine, totalLines), nil
@@ -59,13 +198,12 @@ var ReadFileTool = tools.NewTool("read_file",
 			params.EndLine = totalLines
 		}
 
-		startIdx := params.StartLine - 1
-		endIdx := params.EndLine
-
-		pageLines := lines[startIdx:endIdx]
-		content := formatHashlines(pageLines, startIdx)
-
-		header := fmt.Sprintf("[lines %d-%d of %d]\n", params.StartLine, params.EndLine, totalLines)
-		return header + content, nil
+		if !complete {
+			header := fmt.Sprintf("[lines %d-%d of ?] (the file is %s bytes and wasn't read past line %d, so its line count and version aren't known)\n",
+				params.StartLine, params.EndLine, formatCount(int(info.Size())), params.EndLine)
+			return header + content.String(), nil
+		}
+		header := fmt.Sprintf("[lines %d-%d of %d] [version %s]\n", params.StartLine, params.EndLine, totalLines, version)
+		return header + content.String(), nil
 	}),
 )
@@ -0,0 +1,113 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/modfin/bellman/tools"
+)
+
+const (
+	readFilesDefaultBudget = 64 * 1024
+	readFilesMaxBudget     = 256 * 1024
+)
+
+type readFilesArgs struct {
+	Paths    []string `json:"paths" json-description:"File paths and/or glob patterns (e.g. pkg/*.go, src/**/*.ts) to read"`
+	MaxBytes int      `json:"max_bytes,omitempty" json-description:"Total output budget in bytes (default 65536, max 262144). Files that don't fit are skipped and listed at the end."`
+}
+
+var ReadFilesTool = tools.NewTool("read_files",
+	tools.WithDescription("Read several whole files at once, given paths and/or glob patterns (** matches any number of directories). Each file is returned with a header and hashline-prefixed lines ('line:hash|content') usable with edit_file. Files that would exceed the output budget are skipped and listed at the end; read those with read_file."),
+	tools.WithArgSchema(readFilesArgs{}),
+	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		var params readFilesArgs
+		if err := json.Unmarshal(call.Argument, &params); err != nil {
+			return fmt.Sprintf("error: invalid arguments: %v", err), nil
+		}
+		if len(params.Paths) == 0 {
+			return "error: paths is required", nil
+		}
+		budget := params.MaxBytes
+		if budget <= 0 {
+			budget = readFilesDefaultBudget
+		}
+		budget = min(budget, readFilesMaxBudget)
+
+		var body, skipped strings.Builder
+		seen := map[string]bool{}
+		read, used := 0, 0
+		for _, pattern := range params.Paths {
+			matches, err := expandGlob(pattern)
+			if err != nil {
+				fmt.Fprintf(&skipped, "%s: %v\n", pattern, err)
+				continue
+			}
+			if len(matches) == 0 {
+				fmt.Fprintf(&skipped, "%s: no files matched\n", pattern)
+				continue
+			}
+			globbed := hasGlobMeta(pattern)
+			for _, path := range matches {
+				if seen[path] {
+					continue
+				}
+				seen[path] = true
+
+				info, err := os.Stat(path)
+				if err != nil {
+					fmt.Fprintf(&skipped, "%s: %v\n", path, err)
+					continue
+				}
+				if info.IsDir() {
+					if !globbed {
+						fmt.Fprintf(&skipped, "%s: is a directory\n", path)
+					}
+					continue
+				}
+				if info.Size() > int64(budget-used) {
+					fmt.Fprintf(&skipped, "%s: %d bytes, over the remaining budget\n", path, info.Size())
+					continue
+				}
+
+				data, err := os.ReadFile(path)
+				if err != nil {
+					fmt.Fprintf(&skipped, "%s: %v\n", path, err)
+					continue
+				}
+				if bytes.IndexByte(data[:min(len(data), grepSniffSize)], 0) >= 0 {
+					fmt.Fprintf(&skipped, "%s: binary file\n", path)
+					continue
+				}
+				lines, _ := splitLines(string(data))
+				var section string
+				if len(lines) == 0 {
+					section = fmt.Sprintf("==> %s [lines 0-0 of 0] <==\n(empty file)\n\n", path)
+				} else {
+					section = fmt.Sprintf("==> %s [lines 1-%d of %d] [version %s] <==\n%s\n", path, len(lines), len(lines), fileVersion(data), formatHashlines(lines, 0, hashWidthFromContext(ctx)))
+				}
+				if used+len(section) > budget {
+					fmt.Fprintf(&skipped, "%s: %d bytes, over the remaining budget\n", path, info.Size())
+					continue
+				}
+				body.WriteString(section)
+				recordRead(ctx, path, data)
+				used += len(section)
+				read++
+			}
+		}
+
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "[read %d files, %d of %d bytes]\n\n", read, used, budget)
+		sb.WriteString(body.String())
+		if skipped.Len() > 0 {
+			sb.WriteString("[skipped]\n")
+			sb.WriteString(skipped.String())
+		}
+		return sb.String(), nil
+	}),
+)
@@ -0,0 +1,183 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/modfin/bellman/tools"
+)
+
+type replaceAllArgs struct {
+	Paths         []string `json:"paths" json-description:"Files and/or glob patterns (e.g. pkg/**/*.go) to make the replacement in"`
+	Pattern       string   `json:"pattern" json-description:"The text to find, or a regular expression (Go RE2 syntax) if regex is set"`
+	Replacement   string   `json:"replacement" json-description:"The text to replace each match with. With regex, $1 or ${name} insert capture groups; use $$ for a literal $."`
+	Regex         bool     `json:"regex,omitempty" json-description:"Treat pattern as a regular expression rather than literal text"`
+	ExpectedCount int      `json:"expected_count,omitempty" json-description:"If set, the total number of matches across all files must equal this, or nothing is written"`
+	DryRun        bool     `json:"dry_run,omitempty" json-description:"Show the diffs without writing anything"`
+}
+
+// replaceAllFile is a file replace_all changes.
+type replaceAllFile struct {
+	path     string
+	old, new string
+	count    int
+}
+
+var ReplaceAllTool = tools.NewTool("replace_all",
+	tools.WithDescription("Replace every match of a literal or regular expression pattern across several files, e.g. to rename an identifier throughout a package. Returns a unified diff per changed file. Use dry_run to preview the diffs first, and expected_count to make sure only the matches you expect are replaced. Either all files are written or none are. Files that changed on disk since you last read them are still written, with a warning."),
+	tools.WithArgSchema(replaceAllArgs{}),
+	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		var params replaceAllArgs
+		if err := json.Unmarshal(call.Argument, &params); err != nil {
+			return fmt.Sprintf("error: invalid arguments: %v", err), nil
+		}
+		if len(params.Paths) == 0 {
+			return "error: paths is required", nil
+		}
+		if params.Pattern == "" {
+			return "error: pattern is required", nil
+		}
+		var re *regexp.Regexp
+		if params.Regex {
+			var err error
+			if re, err = regexp.Compile(params.Pattern); err != nil {
+				return fmt.Sprintf("error: invalid pattern: %v", err), nil
+			}
+		}
+
+		var changed []replaceAllFile
+		var notes []string
+		seen := map[string]bool{}
+		searched, total := 0, 0
+		for _, pattern := range params.Paths {
+			matches, err := expandGlob(pattern)
+			if err != nil {
+				return fmt.Sprintf("error: %s: %v", pattern, err), nil
+			}
+			if len(matches) == 0 {
+				notes = append(notes, fmt.Sprintf("%s: no files matched", pattern))
+			}
+			globbed := hasGlobMeta(pattern)
+			for _, path := range matches {
+				if seen[path] {
+					continue
+				}
+				seen[path] = true
+				info, err := os.Stat(path)
+				if err != nil {
+					return fmt.Sprintf("error: %v", err), nil
+				}
+				if info.IsDir() {
+					if !globbed {
+						return fmt.Sprintf("error: %s is a directory", path), nil
+					}
+					continue
+				}
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return fmt.Sprintf("error: %v", err), nil
+				}
+				if bytes.IndexByte(data[:min(len(data), grepSniffSize)], 0) >= 0 {
+					if !globbed {
+						notes = append(notes, fmt.Sprintf("%s: skipped binary file", path))
+					}
+					continue
+				}
+				searched++
+
+				old := string(data)
+				f := replaceAllFile{path: path, old: old}
+				if re != nil {
+					f.count = len(re.FindAllStringIndex(old, -1))
+					f.new = re.ReplaceAllString(old, params.Replacement)
+				} else {
+					f.count = strings.Count(old, params.Pattern)
+					f.new = strings.ReplaceAll(old, params.Pattern, params.Replacement)
+				}
+				if f.count > 0 {
+					changed = append(changed, f)
+					total += f.count
+				}
+			}
+		}
+
+		if params.ExpectedCount > 0 && total != params.ExpectedCount {
+			var counts []string
+			for _, f := range changed {
+				counts = append(counts, fmt.Sprintf("%s: %d", f.path, f.count))
+			}
+			msg := fmt.Sprintf("error: expected %d matches, found %d; nothing was written", params.ExpectedCount, total)
+			if len(counts) > 0 {
+				msg += "\n" + strings.Join(counts, "\n")
+			}
+			return msg, nil
+		}
+		if total == 0 {
+			msg := fmt.Sprintf("no matches for %q in %d file%s", params.Pattern, searched, plural(searched))
+			if len(notes) > 0 {
+				msg += "\n" + strings.Join(notes, "\n")
+			}
+			return msg, nil
+		}
+
+		check := checkFile
+		if params.DryRun {
+			check = peekFile
+		}
+		var diffs strings.Builder
+		for _, f := range changed {
+			// the diffs stand in for reading each file, so only say when
+			// one changed since it was read.
+			if change := check(ctx, f.path); change.changed() {
+				diffs.WriteString(change.warning(f.path))
+			}
+			diffs.WriteString(GenerateDiff(f.path, f.old, f.new))
+		}
+		summary := fmt.Sprintf("%d replacement%s in %d file%s", total, plural(total), len(changed), plural(len(changed)))
+		if params.DryRun {
+			summary = "dry run: " + summary + "; nothing was written"
+		} else {
+			summary = "ok: " + summary
+		}
+		if len(notes) > 0 {
+			summary += "\n" + strings.Join(notes, "\n")
+		}
+		if params.DryRun {
+			return fmt.Sprintf("%s\n\n%s", summary, diffs.String()), nil
+		}
+
+		for _, f := range changed {
+			if err := snapshot(ctx, call, f.path); err != nil {
+				return fmt.Sprintf("error: %v; nothing was written", err), nil
+			}
+		}
+		for i, f := range changed {
+			if err := writeFileAtomic(f.path, []byte(f.new), 0644, followSymlinks); err != nil {
+				// put back the files already written, so it's all or nothing.
+				for _, done := range changed[:i] {
+					if rerr := writeFileAtomic(done.path, []byte(done.old), 0644, followSymlinks); rerr != nil {
+						return fmt.Sprintf("error writing %s: %v; restoring %s also failed: %v", f.path, err, done.path, rerr), nil
+					}
+				}
+				return fmt.Sprintf("error writing %s: %v; nothing was written", f.path, err), nil
+			}
+		}
+		for _, f := range changed {
+			recordRead(ctx, f.path, []byte(f.new))
+		}
+		return fmt.Sprintf("%s\n\n%s", summary, diffs.String()), nil
+	}),
+)
+
+// plural returns "s" unless n is 1.
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
@@ -0,0 +1,64 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Scratch is a session's directory for files tools write for the model to
+// look at later, such as the full output of a bash command that was too
+// long to return. The directory is created on first use.
+type Scratch struct {
+	mu  sync.Mutex
+	dir string
+	n   int
+}
+
+// NewScratch returns an empty Scratch.
+func NewScratch() *Scratch {
+	return &Scratch{}
+}
+
+// create makes a new, uniquely numbered file starting with prefix.
+func (sc *Scratch) create(prefix string) (*os.File, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.dir == "" {
+		dir, err := os.MkdirTemp("", "ajent-scratch-")
+		if err != nil {
+			return nil, err
+		}
+		sc.dir = dir
+	}
+	sc.n++
+	return os.OpenFile(filepath.Join(sc.dir, fmt.Sprintf("%s-%d.log", prefix, sc.n)),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+}
+
+// Close removes the scratch directory and everything in it.
+func (sc *Scratch) Close() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.dir == "" {
+		return nil
+	}
+	err := os.RemoveAll(sc.dir)
+	sc.dir = ""
+	return err
+}
+
+type scratchKey struct{}
+
+// WithScratch returns a context in which tools save files for the model in
+// sc.
+func WithScratch(ctx context.Context, sc *Scratch) context.Context {
+	return context.WithValue(ctx, scratchKey{}, sc)
+}
+
+func scratchFromContext(ctx context.Context) *Scratch {
+	sc, _ := ctx.Value(scratchKey{}).(*Scratch)
+	return sc
+}
@@ -0,0 +1,246 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// shellDriver is the script the persistent shell runs. Commands arrive
+// NUL-terminated on fd 3, so they can't accidentally read each other from
+// stdin. Each is followed by a sentinel line on both stdout and stderr,
+// the stdout one carrying the exit status and resulting working directory.
+// The leading newlines make sure the sentinels start a line even if the
+// command's output didn't end in one.
+const shellDriver = `while IFS= read -r -d '' __ajent_cmd <&3; do
+	eval "$__ajent_cmd" </dev/null
+	__ajent_status=$?
+	printf '\n%s %d %s\n' "$0" "$__ajent_status" "$PWD"
+	printf '\n%s\n' "$0" >&2
+done`
+
+// Shell is a bash process that lives for a whole session, so that the
+// working directory, environment variables and anything else a command
+// sets up carry over to later commands.
+type Shell struct {
+	mu       sync.Mutex
+	dir      string
+	sentinel string
+	cmd      *exec.Cmd
+	script   io.WriteCloser
+	out      *os.File
+	errOut   *os.File
+	lines    *bufio.Reader
+	errLines *bufio.Reader
+}
+
+// NewShell returns a Shell that starts in dir. The bash process is started
+// on first use.
+func NewShell(dir string) *Shell {
+	return &Shell{dir: dir}
+}
+
+// Dir returns the shell's current working directory.
+func (sh *Shell) Dir() string {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.dir
+}
+
+func (sh *Shell) start(env []string) error {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	sh.sentinel = "__ajent_done_" + hex.EncodeToString(b[:])
+
+	scriptR, scriptW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer scriptR.Close()
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		_ = scriptW.Close()
+		return err
+	}
+	defer outW.Close()
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		_ = scriptW.Close()
+		_ = outR.Close()
+		return err
+	}
+	defer errW.Close()
+
+	cmd := exec.Command("bash", "--noprofile", "--norc", "-c", shellDriver, sh.sentinel)
+	cmd.Dir = sh.dir
+	cmd.Env = env
+	cmd.Stdout = outW
+	cmd.Stderr = errW
+	cmd.ExtraFiles = []*os.File{scriptR}
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		_ = scriptW.Close()
+		_ = outR.Close()
+		_ = errR.Close()
+		return err
+	}
+	sh.cmd, sh.script = cmd, scriptW
+	sh.out, sh.lines = outR, bufio.NewReader(outR)
+	sh.errOut, sh.errLines = errR, bufio.NewReader(errR)
+	return nil
+}
+
+// stop kills the bash process and anything it started, returning how it
+// exited. The next command starts a fresh shell in the last known working
+// directory.
+func (sh *Shell) stop() error {
+	if sh.cmd == nil {
+		return nil
+	}
+	_ = signalProcessGroup(sh.cmd, syscall.SIGKILL)
+	_ = sh.script.Close()
+	_ = sh.out.Close()
+	_ = sh.errOut.Close()
+	err := sh.cmd.Wait()
+	sh.cmd = nil
+	return err
+}
+
+// Close stops the shell.
+func (sh *Shell) Close() error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	_ = sh.stop()
+	return nil
+}
+
+// errShellExited is returned by Run when the command made the shell itself
+// exit.
+var errShellExited = errors.New("the shell exited")
+
+// readUntilSentinel copies lines from r to w until it reads a line starting
+// with sentinel, which it returns without the sentinel or line ending.
+func readUntilSentinel(r *bufio.Reader, w io.Writer, sentinel string) (string, error) {
+	var pending []byte // a newline that may precede the sentinel
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			_, _ = w.Write(append(pending, line...))
+			return "", err
+		}
+		if rest, ok := bytes.CutPrefix(line, []byte(sentinel)); ok {
+			return strings.TrimSpace(string(rest)), nil
+		}
+		_, _ = w.Write(pending)
+		pending = nil
+		if bytes.HasSuffix(line, []byte("\n")) {
+			pending = []byte("\n")
+			line = line[:len(line)-1]
+		}
+		_, _ = w.Write(line)
+	}
+}
+
+// Run runs command in the shell. If the shell isn't running yet, it is
+// started with the environment env. If ctx ends first, the shell is killed
+// (and restarted by the next call) and ctx's error is returned along with
+// the output so far.
+func (sh *Shell) Run(ctx context.Context, command string, env []string) (bashResult, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.cmd == nil {
+		if err := sh.start(env); err != nil {
+			return bashResult{exitCode: -1}, err
+		}
+	}
+	if _, err := io.WriteString(sh.script, command+"\x00"); err != nil {
+		_ = sh.stop()
+		return bashResult{exitCode: -1}, err
+	}
+
+	var c outputCollector
+	stdout, stderr := c.streams()
+	var status string
+	var stdoutErr, stderrErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		status, stdoutErr = readUntilSentinel(sh.lines, stdout, sh.sentinel)
+	}()
+	go func() {
+		defer wg.Done()
+		_, stderrErr = readUntilSentinel(sh.errLines, stderr, sh.sentinel)
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		_ = sh.stop()
+		<-done
+		return c.result(), ctx.Err()
+	}
+
+	r := c.result()
+	if stdoutErr != nil || stderrErr != nil {
+		var exitErr *exec.ExitError
+		if errors.As(sh.stop(), &exitErr) {
+			r.exitCode = exitErr.ExitCode()
+		}
+		return r, errShellExited
+	}
+	code, dir, _ := strings.Cut(status, " ")
+	r.exitCode, _ = strconv.Atoi(code)
+	sh.dir = dir
+	return r, nil
+}
+
+type shellKey struct{}
+
+// WithShell returns a context in which bash runs commands in sh rather than
+// in a fresh bash process.
+func WithShell(ctx context.Context, sh *Shell) context.Context {
+	return context.WithValue(ctx, shellKey{}, sh)
+}
+
+func shellFromContext(ctx context.Context) *Shell {
+	sh, _ := ctx.Value(shellKey{}).(*Shell)
+	return sh
+}
+
+// runInShell runs a bash tool command in the persistent shell, noting when
+// the working directory changes or the shell has to be restarted.
+func runInShell(ctx context.Context, sh *Shell, command string, env []string) bashResult {
+	before := sh.Dir()
+	r, err := sh.Run(ctx, command, env)
+	switch {
+	case errors.Is(err, errShellExited):
+		r.notes = append(r.notes, fmt.Sprintf("the shell exited and will restart in %s", sh.Dir()))
+	case ctx.Err() != nil:
+		r.notes = append(r.notes, fmt.Sprintf("the shell was killed and will restart in %s", sh.Dir()))
+	case err != nil:
+		r.notes = append(r.notes, fmt.Sprintf("error: %v", err))
+	}
+	if dir := sh.Dir(); dir != before {
+		r.notes = append(r.notes, fmt.Sprintf("working directory: %s", dir))
+	}
+	return r
+}
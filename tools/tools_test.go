@@ -8,17 +8,32 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/modfin/bellman/tools"
 )
 
 func callTool(t *testing.T, tool tools.Tool, args any) string {
+	t.Helper()
+	return callToolWithContext(t, context.Background(), tool, args)
+}
+
+// callToolWithContext is callTool in ctx, which carries whatever session
+// state (jobs, a shell, a journal, ...) the test needs.
+func callToolWithContext(t *testing.T, ctx context.Context, tool tools.Tool, args any) string {
+	t.Helper()
+	return callToolWithID(t, ctx, tool, "", args)
+}
+
+// callToolWithID is callToolWithContext for a tool call with the given ID,
+// which the undo journal keys its snapshots by.
+func callToolWithID(t *testing.T, ctx context.Context, tool tools.Tool, id string, args any) string {
 	t.Helper()
 	data, err := json.Marshal(args)
 	if err != nil {
 		t.Fatalf("marshal args: %v", err)
 	}
-	result, err := tool.Function(context.Background(), tools.Call{Argument: data})
+	result, err := tool.Function(ctx, tools.Call{ID: id, Name: tool.Name, Argument: data})
 	if err != nil {
 		t.Fatalf("tool %s returned error: %v", tool.Name, err)
 	}
@@ -152,7 +167,7 @@ func TestReadFileLines_NotFound(t *testing.T) {
 
 func TestFormatHashlines_Basic(t *testing.T) {
 	lines := []string{"hello", "world"}
-	result := formatHashlines(lines, 0)
+	result := formatHashlines(lines, 0, DefaultHashWidth)
 
 	h1 := hashLineContent("hello")
 	h2 := hashLineContent("world")
@@ -164,7 +179,7 @@ func TestFormatHashlines_Basic(t *testing.T) {
 
 func TestFormatHashlines_WithOffset(t *testing.T) {
 	lines := []string{"third", "fourth"}
-	result := formatHashlines(lines, 2)
+	result := formatHashlines(lines, 2, DefaultHashWidth)
 
 	if !strings.HasPrefix(result, "3:") {
 		t.Errorf("expected to start with '3:', got %q", result[:10])
@@ -175,12 +190,95 @@ func TestFormatHashlines_WithOffset(t *testing.T) {
 }
 
 func TestFormatHashlines_Empty(t *testing.T) {
-	result := formatHashlines(nil, 0)
+	result := formatHashlines(nil, 0, DefaultHashWidth)
 	if result != "" {
 		t.Errorf("expected empty string, got %q", result)
 	}
 }
 
+// --- hash width and version tests ---
+
+func TestHashLine_Widths(t *testing.T) {
+	wide := hashLine("hello", MaxHashWidth)
+	if len(wide) != MaxHashWidth {
+		t.Fatalf("expected %d digits, got %q", MaxHashWidth, wide)
+	}
+	for width := 1; width <= MaxHashWidth; width++ {
+		if got := hashLine("hello", width); got != wide[MaxHashWidth-width:] {
+			t.Errorf("hashLine width %d = %q, want suffix of %q", width, got, wide)
+		}
+	}
+	if hashLine("hello", DefaultHashWidth) != hashLineContent("hello") {
+		t.Error("expected hashLineContent to use the default width")
+	}
+
+	lines := []string{"hello"}
+	if err := validateHashlineRef(lines, 1, hashLine("hello", 6)); err != nil {
+		t.Errorf("expected wide hash to validate: %v", err)
+	}
+	if err := validateHashlineRef(lines, 1, "0123456789"); err == nil || !strings.Contains(err.Error(), "invalid hash") {
+		t.Errorf("expected invalid hash error, got %v", err)
+	}
+	// a 1-digit hash would match a changed line 1 time in 16.
+	if err := validateHashlineRef(lines, 1, hashLine("hello", 1)); err == nil || !strings.Contains(err.Error(), "invalid hash") {
+		t.Errorf("expected a 1-digit hash to be rejected, got %v", err)
+	}
+}
+
+func TestHashWidth_ReadAndEdit(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "test.txt", "one\ntwo\n")
+	ctx := WithHashWidth(context.Background(), 6)
+
+	read := func(tool tools.Tool, args any) string {
+		data, _ := json.Marshal(args)
+		result, err := tool.Function(ctx, tools.Call{Argument: data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	result := read(ReadFileTool, readFileArgs{Path: path})
+	if !strings.Contains(result, "\n2:"+hashLine("two", 6)+"|two\n") {
+		t.Errorf("expected 6-digit hashes, got: %s", result)
+	}
+	result = read(EditFileTool, editFileArgs{Path: path, Operation: "replace", Start: "2:" + hashLine("two", 6), Content: "TWO"})
+	if !strings.HasPrefix(result, "ok:") {
+		t.Errorf("expected wide reference to work, got: %s", result)
+	}
+	result = read(EditFileTool, editFileArgs{Path: path, Operation: "replace", Start: "2:" + hashLine("two", 6), Content: "2"})
+	if !strings.Contains(result, "expected "+hashLine("two", 6)+", got "+hashLine("TWO", 6)) || !strings.Contains(result, "2:"+hashLine("TWO", 6)+"|TWO") {
+		t.Errorf("expected mismatch with wide context hashes, got: %s", result)
+	}
+}
+
+func TestEditFileTool_Version(t *testing.T) {
+	dir := t.TempDir()
+	// the first and last lines are identical, so a stale reference to one
+	// of them would pass the line hash check alone.
+	path := writeTestFile(t, dir, "test.txt", "}\na\n}\n")
+
+	result := callTool(t, ReadFileTool, readFileArgs{Path: path})
+	version := fileVersion([]byte("}\na\n}\n"))
+	if !strings.HasPrefix(result, "[lines 1-3 of 3] [version "+version+"]\n") {
+		t.Fatalf("expected version in header, got: %s", result)
+	}
+
+	// someone else deletes the middle line.
+	os.WriteFile(path, []byte("}\n}\n"), 0644)
+	result = callTool(t, EditFileTool, editFileArgs{Path: path, Operation: "replace", Start: "2:" + getHash(t, "}"), Content: "x", Version: version})
+	if !strings.HasPrefix(result, "error: "+path+" has changed since version "+version) {
+		t.Errorf("expected version mismatch error, got: %s", result)
+	}
+
+	current := fileVersion([]byte("}\n}\n"))
+	result = callTool(t, EditFileTool, editFileArgs{Path: path, Operation: "insert_after", Start: "1:" + getHash(t, "}"), Content: "b", Version: current})
+	next := fileVersion([]byte("}\nb\n}\n"))
+	if !strings.HasPrefix(result, "ok: insert_after applied to "+path+" (3 lines) [version "+next+"]\n") {
+		t.Errorf("expected the new version in the result, got: %s", result)
+	}
+}
+
 // --- parseHashlineRef tests ---
 
 func TestParseHashlineRef_Valid(t *testing.T) {
@@ -380,6 +478,230 @@ func TestReadFileTool_EndLineClampedToFile(t *testing.T) {
 	}
 }
 
+func TestReadFileTool_Binary(t *testing.T) {
+	dir := t.TempDir()
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR" + strings.Repeat("\x00", 300)
+	path := writeTestFile(t, dir, "image.png", png)
+
+	result := callTool(t, ReadFileTool, readFileArgs{Path: path})
+	if !strings.HasPrefix(result, "[binary file, image/png, 316 bytes; first 256 bytes shown]\n00000000  89 50 4e 47 0d 0a 1a 0a") {
+		t.Errorf("expected a binary summary, got: %s", result)
+	}
+	if n := strings.Count(result, "\n"); n != 17 {
+		t.Errorf("expected 16 lines of hex dump, got %d lines: %s", n, result)
+	}
+}
+
+func TestReadFileTool_LongLine(t *testing.T) {
+	dir := t.TempDir()
+	long := strings.Repeat("x", 4999) + "é"
+	path := writeTestFile(t, dir, "test.txt", long+"\nshort\n")
+
+	result := callTool(t, ReadFileTool, readFileArgs{Path: path})
+	want := "1:" + hashLineContent(long) + "|" + strings.Repeat("x", 2000) + "[... line truncated, 3,001 more bytes]\n2:"
+	if !strings.Contains(result, want) {
+		t.Fatalf("expected the line cut off, got: %s", result)
+	}
+
+	// the hash covers the whole line, so it can still be edited.
+	result = callTool(t, EditFileTool, editFileArgs{Path: path, Operation: "replace", Start: "1:" + hashLineContent(long), Content: "long"})
+	if !strings.HasPrefix(result, "ok:") {
+		t.Errorf("expected edit to succeed, got: %s", result)
+	}
+}
+
+func TestScanLines_MatchesSplitLines(t *testing.T) {
+	for _, content := range []string{"", "\n", "a", "a\n", "a\nb", "a\n\nb\n", "\n\n", strings.Repeat("y", 100000) + "\nz", "a\nb\nc", "a\nb\nc\n", "a\nb\nc\nd\n"} {
+		lines, _ := splitLines(content)
+		page, total, complete, version, err := scanLines(strings.NewReader(content), 2, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case len(lines) > 3:
+			// it stops after the last line asked for.
+			if total != 3 || complete || version != "" {
+				t.Errorf("%.10q: got %d lines, complete %v, version %q; want to stop after 3", content, total, complete, version)
+			}
+		case total != len(lines) || !complete || version != fileVersion([]byte(content)):
+			t.Errorf("%.10q: got %d lines, complete %v, version %s; want %d, true, %s", content, total, complete, version, len(lines), fileVersion([]byte(content)))
+		}
+		want := lines[min(1, len(lines)):min(3, len(lines))]
+		if len(page) != len(want) {
+			t.Errorf("%.10q: got %d lines in range, want %d", content, len(page), len(want))
+			continue
+		}
+		for i, line := range page {
+			if line.size != len(want[i]) || formatLineHash(line.sum, MaxHashWidth) != hashLine(want[i], MaxHashWidth) || !strings.HasPrefix(want[i], string(line.start)) {
+				t.Errorf("%.10q: line %d doesn't match", content, i+2)
+			}
+		}
+	}
+}
+
+func TestReadFileTool_LargeFileStreamed(t *testing.T) {
+	dir := t.TempDir()
+	var sb strings.Builder
+	for i := 1; sb.Len() <= readFileStreamSize; i++ {
+		fmt.Fprintf(&sb, "line %d\n", i)
+		if i == 300 {
+			sb.WriteString(strings.Repeat("z", 3000) + "\n")
+		}
+	}
+	sb.WriteString("last")
+	content := sb.String()
+	path := writeTestFile(t, dir, "big.log", content)
+	lines, _ := splitLines(content)
+
+	for _, r := range [][2]int{{0, 0}, {250, 350}, {len(lines) - 5, 0}} {
+		result := callTool(t, ReadFileTool, readFileArgs{Path: path, StartLine: r[0], EndLine: r[1]})
+		start := max(r[0], 1)
+		end := min(start+maxReadLines-1, len(lines))
+		if r[1] >= start {
+			end = min(end, r[1])
+		}
+		header := fmt.Sprintf("[lines %d-%d of %d] [version %s]\n", start, end, len(lines), fileVersion([]byte(content)))
+		if end < len(lines) {
+			// reading stops after end_line, unless that is the last line.
+			header = fmt.Sprintf("[lines %d-%d of ?] (the file is %s bytes and wasn't read past line %d, so its line count and version aren't known)\n",
+				start, end, formatCount(len(content)), end)
+		}
+		want := header + formatHashlines(lines[start-1:end], start-1, DefaultHashWidth)
+		if result != want {
+			t.Errorf("lines %d-%d: streamed result differs from reading it whole", r[0], r[1])
+		}
+	}
+}
+
+// --- glob tests ---
+
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"*.go", "a.go", true},
+		{"*.go", "dir/a.go", false},
+		{"**/*.go", "a.go", true},
+		{"**/*.go", "dir/sub/a.go", true},
+		{"dir/**", "dir/sub/a.go", true},
+		{"dir/**/a.go", "dir/a.go", true},
+		{"dir/**/a.go", "other/a.go", false},
+		{"src/**/*_test.go", "src/x/y_test.go", true},
+	} {
+		if got := matchGlob(tc.pattern, tc.name); got != tc.match {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.match)
+		}
+	}
+}
+
+func TestExpandGlob_DoubleStar(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir, "top.go", "")
+	writeTestFile(t, dir, "a/b/deep.go", "")
+	writeTestFile(t, dir, "a/b/notes.txt", "")
+
+	matches, err := expandGlob(filepath.Join(dir, "**", "*.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "a", "b", "deep.go"), filepath.Join(dir, "top.go")}
+	if strings.Join(matches, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, matches)
+	}
+}
+
+// --- ignore tests ---
+
+func TestIgnoreMatcher(t *testing.T) {
+	repo := t.TempDir()
+	os.Mkdir(filepath.Join(repo, ".git"), 0755)
+	writeTestFile(t, repo, ".gitignore", "# build output\n/bin\n*.tmp\n!keep.tmp\ndocs/**/draft.md\ncache/\n")
+	os.MkdirAll(filepath.Join(repo, "pkg", "sub"), 0755)
+	writeTestFile(t, repo, "pkg/.gitignore", "!scratch.tmp\n")
+
+	// rules from ancestors up to the repository root apply to a walk
+	// starting below it.
+	m := newIgnoreMatcher(filepath.Join(repo, "pkg"))
+	m.loadDir(filepath.Join(repo, "pkg"))
+	for _, tc := range []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"bin", true, true},
+		{"pkg/bin", true, false},
+		{"pkg/a.tmp", false, true},
+		{"pkg/keep.tmp", false, false},
+		{"pkg/scratch.tmp", false, false},
+		{"a.tmp", false, true},
+		{"docs/a/b/draft.md", false, true},
+		{"draft.md", false, false},
+		{"pkg/sub/cache", true, true},
+		{"pkg/sub/cache", false, false},
+		{"main.go", false, false},
+	} {
+		if got := m.ignored(filepath.Join(repo, tc.path), tc.isDir); got != tc.want {
+			t.Errorf("ignored(%s, %v) = %v, want %v", tc.path, tc.isDir, got, tc.want)
+		}
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	for n, want := range map[int]string{0: "0", 999: "999", 1000: "1,000", 12345: "12,345", 1234567: "1,234,567"} {
+		if got := formatCount(n); got != want {
+			t.Errorf("formatCount(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+// --- read_files tool tests ---
+
+func TestReadFilesTool_GlobsAndPaths(t *testing.T) {
+	dir := t.TempDir()
+	a := writeTestFile(t, dir, "a.go", "package a\n")
+	writeTestFile(t, dir, "b.go", "package b\nfunc B() {}\n")
+	writeTestFile(t, dir, "empty.go", "")
+
+	result := callTool(t, ReadFilesTool, readFilesArgs{Paths: []string{a, filepath.Join(dir, "*.go"), filepath.Join(dir, "*.rs")}})
+	if !strings.HasPrefix(result, "[read 3 files, ") {
+		t.Errorf("expected 3 files read once each, got: %s", result)
+	}
+	expected := "==> " + filepath.Join(dir, "b.go") + " [lines 1-2 of 2] [version " + fileVersion([]byte("package b\nfunc B() {}\n")) + "] <==\n" +
+		"1:" + hashLineContent("package b") + "|package b\n" +
+		"2:" + hashLineContent("func B() {}") + "|func B() {}\n"
+	if !strings.Contains(result, expected) {
+		t.Errorf("expected hashlined b.go section, got: %s", result)
+	}
+	if !strings.Contains(result, "empty.go [lines 0-0 of 0] <==\n(empty file)") {
+		t.Errorf("expected empty file section, got: %s", result)
+	}
+	if !strings.Contains(result, "[skipped]\n"+filepath.Join(dir, "*.rs")+": no files matched\n") {
+		t.Errorf("expected unmatched pattern to be reported, got: %s", result)
+	}
+}
+
+func TestReadFilesTool_Budget(t *testing.T) {
+	dir := t.TempDir()
+	big := writeTestFile(t, dir, "big.txt", strings.Repeat("a long line of text\n", 100))
+	small := writeTestFile(t, dir, "small.txt", "tiny\n")
+	bin := writeTestFile(t, dir, "bin.dat", "\x00\x01\x02")
+
+	result := callTool(t, ReadFilesTool, readFilesArgs{Paths: []string{big, small, bin}, MaxBytes: 500})
+	if !strings.HasPrefix(result, "[read 1 files, ") || !strings.Contains(result, "|tiny\n") {
+		t.Errorf("expected only small.txt to be read, got: %s", result)
+	}
+	if !strings.Contains(result, big+": 2000 bytes, over the remaining budget\n") {
+		t.Errorf("expected big.txt to be skipped for size, got: %s", result)
+	}
+	if !strings.Contains(result, bin+": binary file\n") {
+		t.Errorf("expected bin.dat to be skipped as binary, got: %s", result)
+	}
+}
+
 // --- list_directory tool tests ---
 
 func TestListDirTool_Basic(t *testing.T) {
@@ -461,6 +783,32 @@ func TestListDirTool_LimitCapped(t *testing.T) {
 	}
 }
 
+func TestListDirTool_Ignored(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, ".gitignore", "vendor/\n*.o\n")
+	os.MkdirAll(filepath.Join(dir, "vendor", "lib"), 0755)
+	writeTestFile(t, dir, "vendor/lib/a.go", "")
+	writeTestFile(t, dir, "main.go", "")
+	writeTestFile(t, dir, "a.o", "")
+	writeTestFile(t, dir, "b.o", "")
+
+	result := callTool(t, ListDirTool, listDirArgs{Path: dir})
+	if !strings.HasPrefix(result, "[entries 1-4 of 4]\n") {
+		t.Errorf("expected 4 entries, got: %s", result)
+	}
+	if !strings.Contains(result, "  vendor/ (2 entries, ignored)\n") {
+		t.Errorf("expected vendor summary, got: %s", result)
+	}
+	if !strings.HasSuffix(result, "\n(2 ignored files)\n") || strings.Contains(result, "a.o") {
+		t.Errorf("expected ignored files to be counted, got: %s", result)
+	}
+
+	result = callTool(t, ListDirTool, listDirArgs{Path: dir, IncludeIgnored: true})
+	if !strings.HasPrefix(result, "[entries 1-5 of 5]\n") || !strings.Contains(result, "a.o") {
+		t.Errorf("expected all entries, got: %s", result)
+	}
+}
+
 func TestListDirTool_ShowsPermissions(t *testing.T) {
 	dir := t.TempDir()
 	writeTestFile(t, dir, "test.txt", "hello")
@@ -758,25 +1106,197 @@ func TestEditFileTool_InsertAfterLastLine(t *testing.T) {
 	}
 }
 
+func TestEditFileTool_MultipleEdits(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "test.txt", "one\ntwo\nthree\nfour\nfive\n")
+
+	ref := func(n int, line string) string { return fmt.Sprintf("%d:%s", n, getHash(t, line)) }
+	result := callTool(t, EditFileTool, editFileArgs{
+		Path: path,
+		Edits: []editOp{
+			{Operation: "replace", Start: ref(4, "four"), End: ref(5, "five"), Content: "FOUR-FIVE"},
+			{Operation: "insert_after", Start: ref(1, "one"), Content: "one-a\none-b"},
+			{Operation: "replace", Start: ref(2, "two"), Content: ""},
+			{Operation: "insert_after", Start: ref(1, "one"), Content: "one-c"},
+		},
+	})
+	if !strings.HasPrefix(result, "ok: 4 edits applied to "+path+" (6 lines)") {
+		t.Errorf("expected success, got: %s", result)
+	}
+	if strings.Count(result, "--- "+path) != 1 || strings.Count(result, "+++ "+path) != 1 {
+		t.Errorf("expected a single diff, got: %s", result)
+	}
+	data, _ := os.ReadFile(path)
+	if want := "one\none-a\none-b\none-c\nthree\nFOUR-FIVE\n"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+}
+
+func TestEditFileTool_MultipleEditsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	original := "one\ntwo\nthree\nfour\n"
+	path := writeTestFile(t, dir, "test.txt", original)
+
+	ref := func(n int, line string) string { return fmt.Sprintf("%d:%s", n, getHash(t, line)) }
+	for _, tc := range []struct {
+		edits []editOp
+		want  string
+	}{
+		{
+			[]editOp{
+				{Operation: "replace", Start: ref(1, "one"), Content: "ONE"},
+				{Operation: "replace", Start: ref(3, "three"), Content: "x"},
+				{Operation: "replace", Start: "4:zz", Content: "FOUR"},
+			},
+			"error: edit 3: hash mismatch at line 4",
+		},
+		{
+			[]editOp{
+				{Operation: "replace", Start: ref(1, "one"), End: ref(3, "three"), Content: "x"},
+				{Operation: "replace", Start: ref(3, "three"), End: ref(4, "four"), Content: "y"},
+			},
+			"error: edit 2 (replace lines 3-4) overlaps edit 1 (replace lines 1-3)",
+		},
+		{
+			[]editOp{
+				{Operation: "replace", Start: ref(2, "two"), End: ref(3, "three"), Content: "x"},
+				{Operation: "insert_after", Start: ref(2, "two"), Content: "y"},
+			},
+			"error: edit 2 (insert_after line 2) overlaps edit 1 (replace lines 2-3)",
+		},
+		{
+			[]editOp{{Operation: "delete", Start: ref(1, "one")}},
+			"error: edit 1: unknown operation",
+		},
+	} {
+		result := callTool(t, EditFileTool, editFileArgs{Path: path, Edits: tc.edits})
+		if !strings.HasPrefix(result, tc.want) || !strings.Contains(result, "No edits were applied.") {
+			t.Errorf("expected %q, got: %s", tc.want, result)
+		}
+		if data, _ := os.ReadFile(path); string(data) != original {
+			t.Errorf("file was modified: %q", data)
+		}
+	}
+
+	result := callTool(t, EditFileTool, editFileArgs{
+		Path:      path,
+		Operation: "replace",
+		Start:     ref(1, "one"),
+		Edits:     []editOp{{Operation: "replace", Start: ref(2, "two")}},
+	})
+	if !strings.HasPrefix(result, "error: use either edits") {
+		t.Errorf("expected error for mixed forms, got: %s", result)
+	}
+}
+
+// --- atomic write tests ---
+
+func TestWriteFileAtomic_PreservesMode(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "script.sh", "#!/bin/sh\necho hi\n")
+	if err := os.Chmod(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	result := callTool(t, EditFileTool, editFileArgs{
+		Path:      path,
+		Operation: "replace",
+		Start:     "2:" + getHash(t, "echo hi"),
+		Content:   "echo bye",
+	})
+	if !strings.HasPrefix(result, "ok:") {
+		t.Fatalf("expected success, got: %s", result)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("expected mode 0755, got %v", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected no leftover temp files, got %d entries", len(entries))
+	}
+}
+
+func TestWriteFileAtomic_Symlinks(t *testing.T) {
+	dir := t.TempDir()
+	target := writeTestFile(t, dir, "target.txt", "old\n")
+	link := filepath.Join(dir, "link.txt")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(link, []byte("new\n"), 0644, followSymlinks); err != nil {
+		t.Fatalf("followSymlinks: %v", err)
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected link to remain a symlink")
+	}
+	if data, _ := os.ReadFile(target); string(data) != "new\n" {
+		t.Errorf("expected target to be updated, got %q", data)
+	}
+
+	if err := writeFileAtomic(link, []byte("newer\n"), 0644, refuseSymlinks); err == nil {
+		t.Errorf("expected refuseSymlinks to fail")
+	}
+	if data, _ := os.ReadFile(target); string(data) != "new\n" {
+		t.Errorf("expected target to be unchanged, got %q", data)
+	}
+
+	// create_file won't write through a dangling link.
+	dangling := filepath.Join(dir, "dangling.txt")
+	if err := os.Symlink(filepath.Join(dir, "elsewhere.txt"), dangling); err != nil {
+		t.Fatal(err)
+	}
+	result := callTool(t, CreateFileTool, createFileArgs{Path: dangling, Content: "x"})
+	if !strings.HasPrefix(result, "error:") {
+		t.Errorf("expected error, got: %s", result)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "elsewhere.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected link target not to be created")
+	}
+}
+
+func TestWriteFileAtomic_NewFileAndErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "new.txt")
+	if err := writeFileAtomic(path, []byte("hello"), 0600, followSymlinks); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected new file with mode 0600, got %v, %v", info, err)
+	}
+	if err := writeFileAtomic(dir, []byte("x"), 0644, followSymlinks); err == nil {
+		t.Errorf("expected error writing over a directory")
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "x.txt"), []byte("x"), 0644, followSymlinks); err == nil {
+		t.Errorf("expected error for missing parent directory")
+	}
+}
+
 // --- bash tool tests ---
 
 func TestBashTool_SimpleCommand(t *testing.T) {
 	result := callTool(t, BashTool, bashArgs{Command: "echo hello"})
-	if strings.TrimSpace(result) != "hello" {
-		t.Errorf("expected 'hello', got: %q", result)
+	expected := "exit code: 0\nstdout: 6 bytes\nstderr: 0 bytes\n<stdout>\nhello\n</stdout>\n"
+	if result != expected {
+		t.Errorf("expected %q, got: %q", expected, result)
 	}
 }
 
 func TestBashTool_ExitStatus(t *testing.T) {
-	result := callTool(t, BashTool, bashArgs{Command: "exit 1"})
-	if !strings.Contains(result, "exit status") {
+	result := callTool(t, BashTool, bashArgs{Command: "exit 7"})
+	if !strings.HasPrefix(result, "exit code: 7\n") {
 		t.Errorf("expected exit status error, got: %s", result)
 	}
 }
 
 func TestBashTool_Stderr(t *testing.T) {
-	result := callTool(t, BashTool, bashArgs{Command: "echo error >&2"})
-	if !strings.Contains(result, "error") {
+	result := callTool(t, BashTool, bashArgs{Command: "echo out; echo error >&2"})
+	if !strings.Contains(result, "<stdout>\nout\n</stdout>\n<stderr>\nerror\n</stderr>\n") {
 		t.Errorf("expected stderr in output, got: %s", result)
 	}
 }
@@ -790,13 +1310,62 @@ func TestBashTool_MissingCommand(t *testing.T) {
 
 func TestBashTool_OutputTruncation(t *testing.T) {
 	result := callTool(t, BashTool, bashArgs{
-		Command: "yes 'this is a long line of text for testing truncation' | head -n 100000",
+		Command: "echo 'error: first'; yes 'this is a long line of text for testing truncation' | head -n 100000; echo 'last line'",
+	})
+	if !strings.Contains(result, "stdout: 5100023 bytes (truncated)\n") {
+		t.Errorf("expected truncated stdout in header, got: %.200s", result)
+	}
+	if !strings.Contains(result, "<stdout>\nerror: first\n") || !strings.Contains(result, "last line\n</stdout>") {
+		t.Error("expected head and tail content to be preserved")
+	}
+	if !strings.Contains(result, " bytes elided ...]\n") || len(result) > bashOutputHead+bashOutputTail+500 {
+		t.Errorf("expected elided marker and bounded output, got %d bytes", len(result))
+	}
+
+	_, rest, ok := strings.Cut(result, "full output: ")
+	if !ok {
+		t.Fatalf("expected full output path in header, got: %.300s", result)
+	}
+	path, _, _ := strings.Cut(rest, "\n")
+	defer os.Remove(path)
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != 5100023 {
+		t.Errorf("expected full output in %s, got %v, %v", path, info, err)
+	}
+}
+
+func TestBashTool_OutputBudgetIsShared(t *testing.T) {
+	sc := NewScratch()
+	defer sc.Close()
+	ctx := WithScratch(context.Background(), sc)
+	result := callToolWithContext(t, ctx, BashTool, bashArgs{
+		Command: "seq 100000; seq 100000 >&2",
 	})
-	if !strings.Contains(result, "[output truncated]\n") {
-		t.Error("expected truncation notice in output")
+	if !strings.Contains(result, "stdout: 588895 bytes (truncated)\nstderr: 588895 bytes (truncated)\n") {
+		t.Errorf("expected both streams truncated, got: %.200s", result)
 	}
-	if !strings.Contains(result, "this is a long line") {
-		t.Error("expected tail content to be preserved")
+	if len(result) > bashOutputHead+bashOutputTail+500 {
+		t.Errorf("expected the streams to share one budget, got %d bytes", len(result))
+	}
+	if !strings.Contains(result, "(the full output file is deleted when ajent exits)\n") {
+		t.Errorf("expected a note that the full output is temporary, got: %.300s", result)
+	}
+
+	// a short stream is kept whole.
+	result = callToolWithContext(t, ctx, BashTool, bashArgs{Command: "seq 100000; echo oops >&2"})
+	if !strings.Contains(result, "stderr: 5 bytes\n") || !strings.Contains(result, "<stderr>\noops\n</stderr>") {
+		t.Errorf("expected stderr in full, got: %.300s", result)
+	}
+}
+
+func TestTruncateMiddle(t *testing.T) {
+	data := []byte("one\ntwo\nthree\nfour\nfive\n")
+	if got := string(truncateMiddle(data, 100, 100)); got != string(data) {
+		t.Errorf("expected short data unchanged, got %q", got)
+	}
+	expected := "one\n[... 15 bytes elided ...]\nfive\n"
+	if got := string(truncateMiddle(data, 6, 7)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
 	}
 }
 
@@ -807,67 +1376,340 @@ func TestBashTool_MultilineOutput(t *testing.T) {
 	}
 }
 
-// --- create_file tool tests ---
+func TestBashTool_TimeoutKillsChildren(t *testing.T) {
+	tool := NewBashTool(BashConfig{MaxTimeout: time.Second})
+	start := time.Now()
+	result := callTool(t, tool, bashArgs{Command: "sleep 30 & sleep 30; echo never", Timeout: 60})
+	if !strings.HasPrefix(result, "exit code: none\ntimed out after 1s\n") {
+		t.Errorf("expected timeout capped at 1s, got: %s", result)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("command took %v to time out", elapsed)
+	}
+}
 
-func TestCreateFileTool_Basic(t *testing.T) {
+func TestBashTool_CwdEnvStdin(t *testing.T) {
 	dir := t.TempDir()
-	path := filepath.Join(dir, "new.txt")
+	t.Setenv("AJENT_TEST_API_KEY", "secret")
+	t.Setenv("AJENT_TEST_VISIBLE", "visible")
+	tool := NewBashTool(BashConfig{
+		Env:      map[string]string{"AJENT_TEST_INJECTED": "injected"},
+		ScrubEnv: []string{"*api_key*"},
+	})
 
-	result := callTool(t, CreateFileTool, createFileArgs{Path: path, Content: "hello\nworld\n"})
-	if !strings.Contains(result, "ok: created") {
-		t.Fatalf("expected ok, got: %s", result)
+	result := callTool(t, tool, bashArgs{
+		Command: `pwd; echo "${AJENT_TEST_API_KEY:-scrubbed} $AJENT_TEST_VISIBLE $AJENT_TEST_INJECTED $EXTRA"; cat`,
+		Cwd:     dir,
+		Env:     map[string]string{"EXTRA": "extra"},
+		Stdin:   "from stdin\n",
+	})
+	expected := "<stdout>\n" + dir + "\nscrubbed visible injected extra\nfrom stdin\n</stdout>"
+	if !strings.Contains(result, expected) {
+		t.Errorf("expected %q in result, got: %q", expected, result)
 	}
-	if !strings.Contains(result, "|hello") {
-		t.Errorf("expected hashline content in output, got: %s", result)
+
+	result = callTool(t, tool, bashArgs{Command: "true", Env: map[string]string{"BAD NAME": "x"}})
+	if !strings.HasPrefix(result, "error: invalid environment variable name") {
+		t.Errorf("expected invalid name error, got: %q", result)
 	}
+}
 
-	data, err := os.ReadFile(path)
-	if err != nil {
+func TestBashTool_PersistentShellCwdEnvStdin(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
 		t.Fatal(err)
 	}
-	if string(data) != "hello\nworld\n" {
-		t.Errorf("unexpected file content: %q", string(data))
+	t.Setenv("AJENT_TEST_TOKEN", "secret")
+	sh := NewShell(dir)
+	defer sh.Close()
+	tool := NewBashTool(BashConfig{ScrubEnv: []string{"*TOKEN*"}})
+	run := func(args bashArgs) string {
+		t.Helper()
+		data, _ := json.Marshal(args)
+		result, err := tool.Function(WithShell(context.Background(), sh), tools.Call{Argument: data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	result := run(bashArgs{Command: `pwd; echo "${AJENT_TEST_TOKEN:-scrubbed} $X"; cat`, Cwd: "sub",
+		Env: map[string]string{"X": "it's"}, Stdin: "in\n"})
+	expected := "<stdout>\n" + filepath.Join(dir, "sub") + "\nscrubbed it's\nin\n</stdout>"
+	if !strings.Contains(result, expected) || strings.Contains(result, "working directory:") {
+		t.Errorf("expected %q without a working directory change, got: %q", expected, result)
+	}
+	result = run(bashArgs{Command: `pwd; echo "${X:-unset}"`})
+	if !strings.Contains(result, "<stdout>\n"+dir+"\nunset\n</stdout>") {
+		t.Errorf("expected per-call settings not to persist, got: %q", result)
 	}
 }
 
-func TestCreateFileTool_RefusesOverwrite(t *testing.T) {
-	dir := t.TempDir()
-	path := writeTestFile(t, dir, "existing.txt", "original")
+func TestBashTool_BackgroundJob(t *testing.T) {
+	js := NewJobs()
+	defer js.Close()
+	outputTool := NewBashOutputTool(BashConfig{MaxTimeout: 10 * time.Second})
 
-	result := callTool(t, CreateFileTool, createFileArgs{Path: path, Content: "overwrite"})
-	if !strings.Contains(result, "error: file already exists") {
-		t.Errorf("expected overwrite refusal, got: %s", result)
+	result := callToolWithContext(t, WithJobs(context.Background(), js), BashTool, bashArgs{Command: "echo ready; while read line; do echo got $line; done", Background: true})
+	if !strings.Contains(result, "started job-1") {
+		t.Fatalf("expected job to start, got: %s", result)
+	}
+	result = callToolWithContext(t, WithJobs(context.Background(), js), outputTool, bashOutputArgs{JobID: "job-1", Wait: 5})
+	if !strings.Contains(result, "running") || !strings.Contains(result, "ready\n") {
+		t.Errorf("expected running job with output, got: %s", result)
 	}
 
-	data, _ := os.ReadFile(path)
-	if string(data) != "original" {
-		t.Errorf("file should be unchanged, got: %q", string(data))
+	callToolWithContext(t, WithJobs(context.Background(), js), BashStdinTool, bashStdinArgs{JobID: "job-1", Input: "hello\n", Close: true})
+	deadline := time.Now().Add(5 * time.Second)
+	var output string
+	for !strings.Contains(result, "exited") && time.Now().Before(deadline) {
+		result = callToolWithContext(t, WithJobs(context.Background(), js), outputTool, bashOutputArgs{JobID: "job-1", Wait: 1})
+		output += result
+	}
+	if !strings.Contains(output, "got hello") || strings.Contains(output, "ready") {
+		t.Errorf("expected only new output, got: %s", output)
+	}
+	if !strings.Contains(result, "exit status 0") {
+		t.Errorf("expected job to exit after stdin closed, got: %s", result)
+	}
+
+	result = callToolWithContext(t, WithJobs(context.Background(), js), outputTool, bashOutputArgs{})
+	if !strings.Contains(result, "job-1: echo ready") {
+		t.Errorf("expected job listing, got: %s", result)
+	}
+	result = callToolWithContext(t, WithJobs(context.Background(), js), outputTool, bashOutputArgs{JobID: "job-9"})
+	if !strings.Contains(result, "error: unknown job") {
+		t.Errorf("expected unknown job error, got: %s", result)
 	}
 }
 
-func TestCreateFileTool_EmptyContent(t *testing.T) {
-	dir := t.TempDir()
-	path := filepath.Join(dir, "empty.txt")
+func TestBashTool_BackgroundJobStdinAndOrphans(t *testing.T) {
+	js := NewJobs()
+	defer js.Close()
+	ctx := WithJobs(context.Background(), js)
+	outputTool := NewBashOutputTool(BashConfig{MaxTimeout: 10 * time.Second})
+	waitForExit := func(id string) string {
+		t.Helper()
+		var output string
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(output, "exited") && time.Now().Before(deadline) {
+			output += callToolWithContext(t, ctx, outputTool, bashOutputArgs{JobID: id, Wait: 1})
+		}
+		return output
+	}
 
-	result := callTool(t, CreateFileTool, createFileArgs{Path: path, Content: ""})
-	if !strings.Contains(result, "ok: created") {
-		t.Fatalf("expected ok, got: %s", result)
+	// the initial stdin is all written before bash_stdin can add to it.
+	stdin := strings.Repeat("first\n", 20000)
+	callToolWithContext(t, ctx, BashTool, bashArgs{Command: "cat", Background: true, Stdin: stdin})
+	callToolWithContext(t, ctx, BashStdinTool, bashStdinArgs{JobID: "job-1", Input: "second\n", Close: true})
+	if output := waitForExit("job-1"); !strings.Contains(output, "first\nsecond\n") || strings.Contains(output, "second\nfirst") {
+		t.Errorf("expected the initial stdin before the bash_stdin input, got: %.300s", output)
 	}
-	if !strings.Contains(result, "empty file") {
-		t.Errorf("expected empty file note, got: %s", result)
+
+	// a child left holding the job's output open doesn't keep it running.
+	callToolWithContext(t, ctx, BashTool, bashArgs{Command: "sleep 5 & echo started", Background: true})
+	if output := waitForExit("job-2"); !strings.Contains(output, "exited") {
+		t.Errorf("expected the job to exit despite its background child, got: %s", output)
 	}
 }
 
-func TestCreateFileTool_MissingPath(t *testing.T) {
-	result := callTool(t, CreateFileTool, createFileArgs{Content: "hello"})
-	if !strings.Contains(result, "error:") {
-		t.Errorf("expected error for missing path, got: %s", result)
+func TestBashTool_NegativeOutputSizes(t *testing.T) {
+	tool := NewBashTool(BashConfig{OutputHead: -1, OutputTail: 100})
+	result := callTool(t, tool, bashArgs{Command: "seq 1000"})
+	if !strings.Contains(result, "stdout: 3893 bytes (truncated)\n") || !strings.Contains(result, "1000\n</stdout>") {
+		t.Errorf("expected a negative head to count as none, got: %.300s", result)
 	}
 }
 
-func TestCreateFileTool_NoParentDir(t *testing.T) {
-	result := callTool(t, CreateFileTool, createFileArgs{Path: "/nonexistent/dir/file.txt", Content: "hello"})
-	if !strings.Contains(result, "error:") {
+func TestBashTool_BackgroundJobOutputTruncation(t *testing.T) {
+	js := NewJobs()
+	defer js.Close()
+	sc := NewScratch()
+	defer sc.Close()
+	ctx := WithScratch(WithJobs(context.Background(), js), sc)
+	outputTool := NewBashOutputTool(BashConfig{MaxTimeout: 10 * time.Second})
+
+	callToolWithContext(t, ctx, BashTool, bashArgs{Command: "echo 'error: first'; seq 100000; echo 'last line'", Background: true})
+	var result string
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(result, "exited") && time.Now().Before(deadline) {
+		result = callToolWithContext(t, ctx, outputTool, bashOutputArgs{JobID: "job-1", Wait: 1})
+	}
+	if !strings.HasPrefix(result, "[job-1 exited: exit status 0]\noutput: 588918 bytes (truncated)\nfull output: ") {
+		t.Errorf("expected truncated output with a full output path, got: %.300s", result)
+	}
+	if !strings.Contains(result, "\nerror: first\n") || !strings.HasSuffix(result, "last line\n") {
+		t.Errorf("expected head and tail content to be preserved, got: %.300s", result)
+	}
+	if len(result) > bashOutputHead+bashOutputTail+500 {
+		t.Errorf("expected bounded output, got %d bytes", len(result))
+	}
+
+	// output nobody reads in time loses its middle, not its start.
+	callToolWithContext(t, ctx, BashTool, bashArgs{Command: "echo 'error: first'; seq 1000000; sleep 60", Background: true})
+	j, err := js.get("job-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := func() bool {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		return j.dropped > 0
+	}
+	for deadline := time.Now().Add(5 * time.Second); !dropped() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	result = callToolWithContext(t, ctx, NewBashKillTool(BashConfig{}), bashKillArgs{JobID: "job-2"})
+	if !strings.Contains(result, "\nerror: first\n") || !strings.Contains(result, " bytes elided ...]\n") {
+		t.Errorf("expected the start of the output to be kept, got: %.300s", result)
+	}
+}
+
+func TestBashTool_KillAndClose(t *testing.T) {
+	js := NewJobs()
+	callToolWithContext(t, WithJobs(context.Background(), js), BashTool, bashArgs{Command: "sleep 60", Background: true})
+	callToolWithContext(t, WithJobs(context.Background(), js), BashTool, bashArgs{Command: "sleep 60 & sleep 60", Background: true})
+
+	result := callToolWithContext(t, WithJobs(context.Background(), js), BashKillTool, bashKillArgs{JobID: "job-1"})
+	if !strings.Contains(result, "exited") {
+		t.Errorf("expected job-1 to be stopped, got: %s", result)
+	}
+
+	j, err := js.get("job-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_ = js.Close()
+	select {
+	case <-j.done:
+	default:
+		t.Error("expected Close to stop job-2")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Close took %v", elapsed)
+	}
+	result = callToolWithContext(t, WithJobs(context.Background(), js), BashTool, bashArgs{Command: "true", Background: true})
+	if !strings.Contains(result, "error:") {
+		t.Errorf("expected starting a job after Close to fail, got: %s", result)
+	}
+}
+
+func TestBashTool_PersistentShell(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sh := NewShell(dir)
+	defer sh.Close()
+
+	result := callToolWithContext(t, WithShell(context.Background(), sh), BashTool, bashArgs{Command: "cd sub && export GREETING=hi"})
+	if !strings.Contains(result, "\nworking directory: "+filepath.Join(dir, "sub")+"\n") {
+		t.Errorf("expected working directory change to be reported, got: %q", result)
+	}
+	result = callToolWithContext(t, WithShell(context.Background(), sh), BashTool, bashArgs{Command: "printf %s $GREETING; pwd >&2"})
+	expected := "exit code: 0\nstdout: 2 bytes\nstderr: " + fmt.Sprint(len(dir)+5) + " bytes\n" +
+		"<stdout>\nhi\n</stdout>\n<stderr>\n" + filepath.Join(dir, "sub") + "\n</stderr>\n"
+	if result != expected {
+		t.Errorf("expected state to carry over, got: %q", result)
+	}
+	result = callToolWithContext(t, WithShell(context.Background(), sh), BashTool, bashArgs{Command: "cat; false"})
+	if result != "exit code: 1\nstdout: 0 bytes\nstderr: 0 bytes\n" {
+		t.Errorf("expected exit status and no stdin, got: %q", result)
+	}
+	result = callToolWithContext(t, WithShell(context.Background(), sh), BashTool, bashArgs{Command: "yes 'this is a long line of text for testing truncation' | head -n 100000"})
+	if !strings.Contains(result, "stderr: 0 bytes\nfull output: ") || len(result) > bashOutputHead+bashOutputTail+500 {
+		t.Errorf("expected truncated output, got %d bytes", len(result))
+	}
+
+	result = callToolWithContext(t, WithShell(context.Background(), sh), BashTool, bashArgs{Command: "echo bye; exit 3"})
+	if !strings.HasPrefix(result, "exit code: 3\nthe shell exited") || !strings.Contains(result, "bye") {
+		t.Errorf("expected shell exit to be reported, got: %q", result)
+	}
+	result = callToolWithContext(t, WithShell(context.Background(), sh), BashTool, bashArgs{Command: "pwd; echo ${GREETING:-unset}"})
+	if !strings.Contains(result, "<stdout>\n"+filepath.Join(dir, "sub")+"\nunset\n</stdout>") {
+		t.Errorf("expected a fresh shell in the last directory, got: %q", result)
+	}
+}
+
+func TestBashTool_PersistentShellTimeout(t *testing.T) {
+	sh := NewShell(t.TempDir())
+	defer sh.Close()
+	tool := NewBashTool(BashConfig{MaxTimeout: time.Second})
+	data, _ := json.Marshal(bashArgs{Command: "echo started; sleep 30", Timeout: 5})
+	result, err := tool.Function(WithShell(context.Background(), sh), tools.Call{Argument: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(result, "timed out after 1s") || !strings.Contains(result, "started") {
+		t.Errorf("expected timeout with partial output, got: %q", result)
+	}
+	if result := callToolWithContext(t, WithShell(context.Background(), sh), BashTool, bashArgs{Command: "echo again"}); !strings.Contains(result, "<stdout>\nagain\n</stdout>") {
+		t.Errorf("expected the shell to restart, got: %q", result)
+	}
+}
+
+// --- create_file tool tests ---
+
+func TestCreateFileTool_Basic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "new.txt")
+
+	result := callTool(t, CreateFileTool, createFileArgs{Path: path, Content: "hello\nworld\n"})
+	if !strings.Contains(result, "ok: created") {
+		t.Fatalf("expected ok, got: %s", result)
+	}
+	if !strings.Contains(result, "|hello") {
+		t.Errorf("expected hashline content in output, got: %s", result)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello\nworld\n" {
+		t.Errorf("unexpected file content: %q", string(data))
+	}
+}
+
+func TestCreateFileTool_RefusesOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "existing.txt", "original")
+
+	result := callTool(t, CreateFileTool, createFileArgs{Path: path, Content: "overwrite"})
+	if !strings.Contains(result, "error: file already exists") {
+		t.Errorf("expected overwrite refusal, got: %s", result)
+	}
+
+	data, _ := os.ReadFile(path)
+	if string(data) != "original" {
+		t.Errorf("file should be unchanged, got: %q", string(data))
+	}
+}
+
+func TestCreateFileTool_EmptyContent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "empty.txt")
+
+	result := callTool(t, CreateFileTool, createFileArgs{Path: path, Content: ""})
+	if !strings.Contains(result, "ok: created") {
+		t.Fatalf("expected ok, got: %s", result)
+	}
+	if !strings.Contains(result, "empty file") {
+		t.Errorf("expected empty file note, got: %s", result)
+	}
+}
+
+func TestCreateFileTool_MissingPath(t *testing.T) {
+	result := callTool(t, CreateFileTool, createFileArgs{Content: "hello"})
+	if !strings.Contains(result, "error:") {
+		t.Errorf("expected error for missing path, got: %s", result)
+	}
+}
+
+func TestCreateFileTool_NoParentDir(t *testing.T) {
+	result := callTool(t, CreateFileTool, createFileArgs{Path: "/nonexistent/dir/file.txt", Content: "hello"})
+	if !strings.Contains(result, "error:") {
 		t.Errorf("expected error for missing parent dir, got: %s", result)
 	}
 }
@@ -939,6 +1781,22 @@ func TestGrepFileTool_ContextLines(t *testing.T) {
 	}
 }
 
+func TestGrepFileTool_LongLines(t *testing.T) {
+	dir := t.TempDir()
+	long := strings.Repeat("x", 5000)
+	path := writeTestFile(t, dir, "test.txt", long+"needle\n"+long+"\n")
+
+	for _, contextLines := range []int{0, 1} {
+		result := callTool(t, GrepFileTool, grepFileArgs{Path: path, Query: "needle", ContextLines: contextLines})
+		if !strings.Contains(result, "[... line truncated, 3,006 more bytes]") || len(result) > 3*maxLineLength {
+			t.Errorf("expected long lines to be cut off, got %d bytes: %.300s", len(result), result)
+		}
+	}
+	if ctx := formatContextLines([]string{long}, 1, 2, DefaultHashWidth); len(ctx) > maxLineLength+100 {
+		t.Errorf("expected edit_file's context lines to be cut off, got %d bytes", len(ctx))
+	}
+}
+
 func TestGrepFileTool_ContextLinesMerge(t *testing.T) {
 	dir := t.TempDir()
 	path := writeTestFile(t, dir, "test.txt", "aaa\nbbb\nccc\nddd\neee\n")
@@ -1031,6 +1889,264 @@ func TestGrepFileTool_MissingArgs(t *testing.T) {
 	}
 }
 
+// --- grep tool tests ---
+
+func TestGrepTool_GroupsByFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.go", "package a\nfunc Hello() {}\n")
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir, "sub/b.go", "package b\n\nfunc HelloAgain() {}\n")
+	writeTestFile(t, dir, "c.txt", "Hello there\n")
+
+	result := callTool(t, GrepTool, grepArgs{Pattern: `func Hello\w*`, Path: dir})
+	if !strings.HasPrefix(result, "2 matches in 2 files:\n") {
+		t.Errorf("expected header, got: %s", result)
+	}
+	a := fmt.Sprintf("==> %s <==\n2:%s|func Hello() {}\n", filepath.Join(dir, "a.go"), hashLineContent("func Hello() {}"))
+	b := fmt.Sprintf("==> %s <==\n3:%s|func HelloAgain() {}\n", filepath.Join(dir, "sub", "b.go"), hashLineContent("func HelloAgain() {}"))
+	if !strings.Contains(result, a+"\n"+b) {
+		t.Errorf("expected grouped matches, got: %s", result)
+	}
+
+	result = callTool(t, GrepTool, grepArgs{Pattern: "Hello", Path: dir, Include: []string{"*.go"}, Exclude: []string{"sub"}})
+	if !strings.HasPrefix(result, "1 match in 1 file:\n") || !strings.Contains(result, "a.go") {
+		t.Errorf("expected only a.go, got: %s", result)
+	}
+}
+
+func TestGrepTool_CaseInsensitiveAndLiteral(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.txt", "HELLO\nhello\na.b\naxb\n")
+
+	result := callTool(t, GrepTool, grepArgs{Pattern: "hello", Path: dir, CaseInsensitive: true})
+	if !strings.HasPrefix(result, "2 matches") {
+		t.Errorf("expected 2 matches, got: %s", result)
+	}
+	result = callTool(t, GrepTool, grepArgs{Pattern: "a.b", Path: dir, Literal: true})
+	if !strings.HasPrefix(result, "1 match") || !strings.Contains(result, "|a.b\n") {
+		t.Errorf("expected literal match only, got: %s", result)
+	}
+}
+
+func TestGrepTool_ContextLines(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "a.txt", "aaa\nbbb\nccc\nddd\neee\n")
+
+	result := callTool(t, GrepTool, grepArgs{Pattern: "bbb|ddd", Path: dir, ContextLines: 1})
+	lines := []string{"aaa", "bbb", "ccc", "ddd", "eee"}
+	want := fmt.Sprintf("2 matches in 1 file:\n==> %s <==\n%s", path, formatMatches(lines, []int{1, 3}, 1, DefaultHashWidth))
+	if result != want {
+		t.Errorf("got:\n%s\nwant:\n%s", result, want)
+	}
+	if !strings.Contains(result, "  3:") || strings.Count(result, "\n> ") != 2 {
+		t.Errorf("expected one merged group, got: %s", result)
+	}
+}
+
+func TestGrepTool_RespectsGitignore(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, ".gitignore", "*.log\nbuild/\n")
+	writeTestFile(t, dir, "main.go", "needle\n")
+	writeTestFile(t, dir, "debug.log", "needle\n")
+	for _, sub := range []string{"build", "pkg"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, dir, "build/out.go", "needle\n")
+	writeTestFile(t, dir, "pkg/.gitignore", "!keep.log\ngen.go\n")
+	writeTestFile(t, dir, "pkg/keep.log", "needle\n")
+	writeTestFile(t, dir, "pkg/gen.go", "needle\n")
+
+	result := callTool(t, GrepTool, grepArgs{Pattern: "needle", Path: dir})
+	if !strings.HasPrefix(result, "2 matches in 2 files:") {
+		t.Errorf("expected 2 matches, got: %s", result)
+	}
+	for _, name := range []string{"main.go", "keep.log"} {
+		if !strings.Contains(result, name) {
+			t.Errorf("expected %s to be searched, got: %s", name, result)
+		}
+	}
+
+	result = callTool(t, GrepTool, grepArgs{Pattern: "needle", Path: dir, IncludeIgnored: true})
+	if !strings.HasPrefix(result, "5 matches in 5 files:") {
+		t.Errorf("expected ignored files to be searched, got: %s", result)
+	}
+}
+
+func TestGrepTool_SkipsBinaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "blob.bin", "needle\x00\x01\x02")
+
+	result := callTool(t, GrepTool, grepArgs{Pattern: "needle", Path: dir})
+	if !strings.Contains(result, "no matches") || !strings.Contains(result, "1 binary files skipped") {
+		t.Errorf("expected binary file to be skipped, got: %s", result)
+	}
+}
+
+func TestGrepTool_CapAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("match\n", 60)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeTestFile(t, dir, name, content)
+	}
+
+	result := callTool(t, GrepTool, grepArgs{Pattern: "match", Path: dir})
+	if !strings.HasPrefix(result, "100 matches in 2 files:") {
+		t.Errorf("expected cap across files, got: %s", result)
+	}
+	if !strings.Contains(result, "truncated at 100 matches") {
+		t.Errorf("expected truncation note, got: %s", result)
+	}
+}
+
+func TestGrepTool_Errors(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range []grepArgs{
+		{Path: dir},
+		{Pattern: "(", Path: dir},
+		{Pattern: "x", Path: filepath.Join(dir, "missing")},
+		{Pattern: "x", Path: dir, Include: []string{"["}},
+	} {
+		if result := callTool(t, GrepTool, args); !strings.HasPrefix(result, "error:") {
+			t.Errorf("%+v: expected error, got: %s", args, result)
+		}
+	}
+}
+
+// --- find_files tool tests ---
+
+func TestFindFilesTool_NameAndType(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"cmd", "cmd/session", "pkg"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, dir, "session.go", "")
+	writeTestFile(t, dir, "cmd/session/main.go", "")
+	writeTestFile(t, dir, "pkg/session_test.go", "")
+	writeTestFile(t, dir, "pkg/other.go", "")
+
+	result := callTool(t, FindFilesTool, findFilesArgs{Path: dir, Name: "session*"})
+	want := fmt.Sprintf("[entries 1-3 of 3]\n%s/\n%s\n%s\n",
+		filepath.Join(dir, "cmd", "session"), filepath.Join(dir, "pkg", "session_test.go"), filepath.Join(dir, "session.go"))
+	if result != want {
+		t.Errorf("got:\n%s\nwant:\n%s", result, want)
+	}
+
+	result = callTool(t, FindFilesTool, findFilesArgs{Path: dir, Name: "session*", Type: "file"})
+	if !strings.HasPrefix(result, "[entries 1-2 of 2]") || strings.Contains(result, "cmd") {
+		t.Errorf("expected only files, got: %s", result)
+	}
+	result = callTool(t, FindFilesTool, findFilesArgs{Path: dir, Name: "cmd/**/*.go"})
+	if result != fmt.Sprintf("[entries 1-1 of 1]\n%s\n", filepath.Join(dir, "cmd", "session", "main.go")) {
+		t.Errorf("expected path glob match, got: %s", result)
+	}
+	result = callTool(t, FindFilesTool, findFilesArgs{Path: dir, Regex: `^session(_test)?\.go$`})
+	if !strings.HasPrefix(result, "[entries 1-2 of 2]") {
+		t.Errorf("expected 2 regex matches, got: %s", result)
+	}
+	result = callTool(t, FindFilesTool, findFilesArgs{Path: dir, Type: "dir", MaxDepth: 1})
+	if result != fmt.Sprintf("[entries 1-2 of 2]\n%s/\n%s/\n", filepath.Join(dir, "cmd"), filepath.Join(dir, "pkg")) {
+		t.Errorf("expected top-level dirs, got: %s", result)
+	}
+}
+
+func TestFindFilesTool_SizeAndTime(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "small.txt", "x")
+	writeTestFile(t, dir, "big.txt", strings.Repeat("x", 2000))
+	old := writeTestFile(t, dir, "old.txt", "xx")
+	past := time.Now().Add(-10 * 24 * time.Hour)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	result := callTool(t, FindFilesTool, findFilesArgs{Path: dir, MinSize: 1000})
+	if result != fmt.Sprintf("[entries 1-1 of 1]\n%s\n", filepath.Join(dir, "big.txt")) {
+		t.Errorf("expected big.txt, got: %s", result)
+	}
+	result = callTool(t, FindFilesTool, findFilesArgs{Path: dir, MaxSize: 1})
+	if result != fmt.Sprintf("[entries 1-1 of 1]\n%s\n", filepath.Join(dir, "small.txt")) {
+		t.Errorf("expected small.txt, got: %s", result)
+	}
+	result = callTool(t, FindFilesTool, findFilesArgs{Path: dir, OlderThan: "7d"})
+	if result != fmt.Sprintf("[entries 1-1 of 1]\n%s\n", old) {
+		t.Errorf("expected old.txt, got: %s", result)
+	}
+	result = callTool(t, FindFilesTool, findFilesArgs{Path: dir, NewerThan: "1h"})
+	if !strings.HasPrefix(result, "[entries 1-2 of 2]") || strings.Contains(result, "old.txt") {
+		t.Errorf("expected recent files, got: %s", result)
+	}
+}
+
+func TestFindFilesTool_SymlinkAndGitignore(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, ".gitignore", "vendor/\n")
+	if err := os.Mkdir(filepath.Join(dir, "vendor"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir, "vendor/lib.go", "")
+	target := writeTestFile(t, dir, "lib.go", "")
+	if err := os.Symlink(target, filepath.Join(dir, "link.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	result := callTool(t, FindFilesTool, findFilesArgs{Path: dir, Name: "*.go"})
+	if !strings.HasPrefix(result, "[entries 1-2 of 2]") || strings.Contains(result, "vendor") {
+		t.Errorf("expected vendor to be ignored, got: %s", result)
+	}
+	result = callTool(t, FindFilesTool, findFilesArgs{Path: dir, Name: "*.go", IncludeIgnored: true})
+	if !strings.HasPrefix(result, "[entries 1-3 of 3]") {
+		t.Errorf("expected vendor to be included, got: %s", result)
+	}
+	result = callTool(t, FindFilesTool, findFilesArgs{Path: dir, Type: "symlink"})
+	if result != fmt.Sprintf("[entries 1-1 of 1]\n%s\n", filepath.Join(dir, "link.go")) {
+		t.Errorf("expected the symlink, got: %s", result)
+	}
+}
+
+func TestFindFilesTool_Pagination(t *testing.T) {
+	dir := t.TempDir()
+	for i := range 5 {
+		writeTestFile(t, dir, fmt.Sprintf("f%d.txt", i), "")
+	}
+
+	result := callTool(t, FindFilesTool, findFilesArgs{Path: dir, Offset: 2, Limit: 2})
+	want := fmt.Sprintf("[entries 2-3 of 5]\n%s\n%s\n", filepath.Join(dir, "f1.txt"), filepath.Join(dir, "f2.txt"))
+	if result != want {
+		t.Errorf("got:\n%s\nwant:\n%s", result, want)
+	}
+	result = callTool(t, FindFilesTool, findFilesArgs{Path: dir, Offset: 6})
+	if !strings.HasPrefix(result, "error: offset 6") {
+		t.Errorf("expected offset error, got: %s", result)
+	}
+	result = callTool(t, FindFilesTool, findFilesArgs{Path: dir, Name: "*.go"})
+	if result != "[entries 0-0 of 0]\n(no matches)" {
+		t.Errorf("expected no matches, got: %s", result)
+	}
+}
+
+func TestFindFilesTool_Errors(t *testing.T) {
+	dir := t.TempDir()
+	file := writeTestFile(t, dir, "a.txt", "")
+	for _, args := range []findFilesArgs{
+		{Path: filepath.Join(dir, "missing")},
+		{Path: file},
+		{Path: dir, Type: "socket"},
+		{Path: dir, Regex: "("},
+		{Path: dir, Name: "["},
+		{Path: dir, NewerThan: "soon"},
+	} {
+		if result := callTool(t, FindFilesTool, args); !strings.HasPrefix(result, "error:") {
+			t.Errorf("%+v: expected error, got: %s", args, result)
+		}
+	}
+}
+
 // --- tree tool tests ---
 
 func TestTreeTool_Basic(t *testing.T) {
@@ -1163,6 +2279,43 @@ func TestTreeTool_TreeFormat(t *testing.T) {
 	}
 }
 
+func TestTreeTool_Ignored(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, ".gitignore", "node_modules/\n*.log\n")
+	writeTestFile(t, dir, ".ajentignore", "fixtures/\n")
+	for _, sub := range []string{"node_modules/a", "fixtures", "src"} {
+		os.MkdirAll(filepath.Join(dir, sub), 0755)
+	}
+	writeTestFile(t, dir, "node_modules/a/index.js", "")
+	writeTestFile(t, dir, "node_modules/b.js", "")
+	writeTestFile(t, dir, "fixtures/x.json", "")
+	writeTestFile(t, dir, "src/main.go", "")
+	writeTestFile(t, dir, "src/.gitignore", "gen_*.go\n")
+	writeTestFile(t, dir, "src/gen_a.go", "")
+	writeTestFile(t, dir, "src/gen_b.go", "")
+	writeTestFile(t, dir, "debug.log", "")
+
+	result := callTool(t, TreeTool, treeArgs{Path: dir})
+	want := "[lines 1-7 of 7]\n" +
+		".\n" +
+		"├── fixtures/ (1 entry, ignored)\n" +
+		"├── node_modules/ (3 entries, ignored)\n" +
+		"├── src\n" +
+		"│   ├── main.go\n" +
+		"│   └── (2 ignored files)\n" +
+		"└── (1 ignored file)\n"
+	if result != want {
+		t.Errorf("got:\n%s\nwant:\n%s", result, want)
+	}
+
+	result = callTool(t, TreeTool, treeArgs{Path: dir, IncludeIgnored: true})
+	for _, name := range []string{"index.js", "x.json", "gen_a.go", "debug.log"} {
+		if !strings.Contains(result, name) {
+			t.Errorf("expected %s with include_ignored, got: %s", name, result)
+		}
+	}
+}
+
 // --- find_replace tool tests ---
 
 func TestFindReplaceTool_Basic(t *testing.T) {
@@ -1259,6 +2412,54 @@ func TestFindReplaceTool_MultipleOccurrences(t *testing.T) {
 	}
 }
 
+func TestFindReplaceTool_TrailingWhitespace(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "test.txt", "one  \ntwo\t\nthree\n")
+
+	result := callTool(t, FindReplaceTool, findReplaceArgs{Path: path, OldText: "one\ntwo", NewText: "ONE\nTWO"})
+	if !strings.Contains(result, "note: old_text was not found exactly; matched lines 1-2 ignoring trailing whitespace\n") {
+		t.Errorf("expected trailing whitespace note, got: %s", result)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "ONE\nTWO\nthree\n" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestFindReplaceTool_Reindents(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "test.go", "func f() {\n\tif x {\n\t\ty()\n\t}\n}\n")
+
+	result := callTool(t, FindReplaceTool, findReplaceArgs{
+		Path:    path,
+		OldText: "    if x {\n        y()\n    }\n",
+		NewText: "    if x {\n        y()\n        z()\n    }\n    w()\n",
+	})
+	if !strings.Contains(result, "matched lines 2-4 ignoring indentation, and new_text was re-indented to match\n") {
+		t.Errorf("expected indentation note, got: %s", result)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "func f() {\n\tif x {\n\t\ty()\n\t\tz()\n\t}\n\tw()\n}\n" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestFindReplaceTool_FuzzyMustBeUnique(t *testing.T) {
+	dir := t.TempDir()
+	original := "\tfoo()\nbar()\n  foo()\n"
+	path := writeTestFile(t, dir, "test.txt", original)
+
+	result := callTool(t, FindReplaceTool, findReplaceArgs{Path: path, OldText: "foo()", NewText: "baz()"})
+	if !strings.HasPrefix(result, "error: found 2 occurrences") {
+		t.Errorf("expected exact ambiguity error, got: %s", result)
+	}
+	result = callTool(t, FindReplaceTool, findReplaceArgs{Path: path, OldText: "    foo()\n", NewText: "baz()"})
+	if !strings.HasPrefix(result, "error: old_text not found exactly, and found 2 occurrences ignoring indentation") {
+		t.Errorf("expected fuzzy ambiguity error, got: %s", result)
+	}
+	if data, _ := os.ReadFile(path); string(data) != original {
+		t.Errorf("file was modified: %q", data)
+	}
+}
+
 func TestFindReplaceTool_MissingPath(t *testing.T) {
 	result := callTool(t, FindReplaceTool, findReplaceArgs{
 		OldText: "x",
@@ -1290,6 +2491,130 @@ func TestFindReplaceTool_NonexistentFile(t *testing.T) {
 	}
 }
 
+// --- replace_all tool tests ---
+
+func TestReplaceAllTool_DryRunThenApply(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "pkg", "sub"), 0755)
+	a := writeTestFile(t, dir, "pkg/a.go", "func oldName() {}\nvar x = oldName()\n")
+	b := writeTestFile(t, dir, "pkg/sub/b.go", "y := oldName()\n")
+	c := writeTestFile(t, dir, "pkg/c.txt", "oldName\n")
+
+	args := replaceAllArgs{
+		Paths:       []string{filepath.Join(dir, "pkg", "**", "*.go")},
+		Pattern:     "oldName",
+		Replacement: "newName",
+		DryRun:      true,
+	}
+	result := callTool(t, ReplaceAllTool, args)
+	if !strings.HasPrefix(result, "dry run: 3 replacements in 2 files; nothing was written\n") {
+		t.Errorf("expected dry run summary, got: %s", result)
+	}
+	if !strings.Contains(result, GenerateDiff(a, "func oldName() {}\nvar x = oldName()\n", "func newName() {}\nvar x = newName()\n")) {
+		t.Errorf("expected diff for a.go, got: %s", result)
+	}
+	if data, _ := os.ReadFile(a); !strings.Contains(string(data), "oldName") {
+		t.Errorf("dry run modified %s", a)
+	}
+
+	args.DryRun = false
+	result = callTool(t, ReplaceAllTool, args)
+	if !strings.HasPrefix(result, "ok: 3 replacements in 2 files\n") {
+		t.Errorf("expected success, got: %s", result)
+	}
+	for path, want := range map[string]string{
+		a: "func newName() {}\nvar x = newName()\n",
+		b: "y := newName()\n",
+		c: "oldName\n",
+	} {
+		if data, _ := os.ReadFile(path); string(data) != want {
+			t.Errorf("%s: got %q, want %q", path, data, want)
+		}
+	}
+}
+
+func TestReplaceAllTool_RegexCaptureGroups(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "a.go", "getFoo()\ngetBar()\nget()\n")
+
+	result := callTool(t, ReplaceAllTool, replaceAllArgs{
+		Paths:       []string{path},
+		Pattern:     `get(\w+)\(\)`,
+		Replacement: "${1}Value()",
+		Regex:       true,
+	})
+	if !strings.HasPrefix(result, "ok: 2 replacements in 1 file\n") {
+		t.Errorf("expected success, got: %s", result)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "FooValue()\nBarValue()\nget()\n" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestReplaceAllTool_ExpectedCount(t *testing.T) {
+	dir := t.TempDir()
+	a := writeTestFile(t, dir, "a.txt", "foo foo\n")
+	b := writeTestFile(t, dir, "b.txt", "foo\n")
+
+	result := callTool(t, ReplaceAllTool, replaceAllArgs{
+		Paths:         []string{filepath.Join(dir, "*.txt")},
+		Pattern:       "foo",
+		Replacement:   "bar",
+		ExpectedCount: 2,
+	})
+	want := fmt.Sprintf("error: expected 2 matches, found 3; nothing was written\n%s: 2\n%s: 1", a, b)
+	if result != want {
+		t.Errorf("got:\n%s\nwant:\n%s", result, want)
+	}
+	if data, _ := os.ReadFile(a); string(data) != "foo foo\n" {
+		t.Errorf("expected a.txt to be unchanged, got %q", data)
+	}
+}
+
+func TestReplaceAllTool_NoMatchesAndErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "a.txt", "hello\n")
+
+	result := callTool(t, ReplaceAllTool, replaceAllArgs{Paths: []string{path}, Pattern: "xyz"})
+	if result != `no matches for "xyz" in 1 file` {
+		t.Errorf("expected no matches, got: %s", result)
+	}
+	for _, args := range []replaceAllArgs{
+		{Pattern: "x"},
+		{Paths: []string{path}},
+		{Paths: []string{path}, Pattern: "(", Regex: true},
+		{Paths: []string{dir}, Pattern: "x"},
+	} {
+		if result := callTool(t, ReplaceAllTool, args); !strings.HasPrefix(result, "error:") {
+			t.Errorf("%+v: expected error, got: %s", args, result)
+		}
+	}
+}
+
+func TestReplaceAllTool_Undo(t *testing.T) {
+	dir := t.TempDir()
+	j, err := OpenJournal(filepath.Join(dir, "session.edits.hjl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	a := writeTestFile(t, dir, "a.txt", "foo\n")
+	b := writeTestFile(t, dir, "b.txt", "foo\n")
+
+	result := callToolWithID(t, WithJournal(context.Background(), j), ReplaceAllTool, "call-1", replaceAllArgs{Paths: []string{a, b}, Pattern: "foo", Replacement: "bar"})
+	if !strings.HasPrefix(result, "ok:") {
+		t.Fatalf("expected success, got: %s", result)
+	}
+	if _, err := j.Undo("call-1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{a, b} {
+		if data, _ := os.ReadFile(path); string(data) != "foo\n" {
+			t.Errorf("%s: expected undo to restore, got %q", path, data)
+		}
+	}
+}
+
 // --- Integration: read then edit ---
 
 func TestIntegration_ReadThenEdit(t *testing.T) {
@@ -1334,3 +2659,266 @@ func TestIntegration_ReadThenEdit(t *testing.T) {
 		t.Errorf("did not expect 'world' in edited file")
 	}
 }
+
+// --- undo journal tests ---
+
+func TestJournal_UndoRestoresAndSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "session.edits.hjl")
+	j, err := OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestFile(t, dir, "a.txt", "one\ntwo")
+	created := filepath.Join(dir, "b.txt")
+
+	callToolWithID(t, WithJournal(context.Background(), j), FindReplaceTool, "call-1", findReplaceArgs{Path: path, OldText: "one", NewText: "1"})
+	callToolWithID(t, WithJournal(context.Background(), j), FindReplaceTool, "call-2", findReplaceArgs{Path: path, OldText: "two", NewText: "2"})
+	callToolWithID(t, WithJournal(context.Background(), j), CreateFileTool, "call-3", createFileArgs{Path: created, Content: "new\n"})
+	_ = j.Close()
+
+	j, err = OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if len(j.Entries()) != 3 {
+		t.Fatalf("expected 3 entries after reopen, got %d", len(j.Entries()))
+	}
+
+	result := callToolWithID(t, WithJournal(context.Background(), j), UndoEditTool, "call-4", undoEditArgs{CallID: "call-2"})
+	if !strings.HasPrefix(result, "ok:") {
+		t.Fatalf("undo failed: %s", result)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "1\ntwo" {
+		t.Errorf("expected a.txt as of before call-2, got %q", data)
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Errorf("expected b.txt to be removed, got %v", err)
+	}
+
+	result = callToolWithID(t, WithJournal(context.Background(), j), UndoEditTool, "call-5", undoEditArgs{})
+	if !strings.Contains(result, "call-1 find_replace: modified") || strings.Contains(result, "call-2") {
+		t.Errorf("unexpected journal listing: %s", result)
+	}
+	result = callToolWithID(t, WithJournal(context.Background(), j), UndoEditTool, "call-6", undoEditArgs{CallID: "call-3"})
+	if !strings.Contains(result, "error:") {
+		t.Errorf("expected error undoing an already undone call, got: %s", result)
+	}
+}
+
+func TestJournal_DiscardsTruncatedRecord(t *testing.T) {
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "session.edits.hjl")
+	j, err := OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestFile(t, dir, "a.txt", "one\n")
+	if err := j.Snapshot("call-1", "edit_file", path); err != nil {
+		t.Fatal(err)
+	}
+	_ = j.Close()
+
+	fh, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fh.WriteString("{\"edit\":{\"call_id\":\"call-2\"}}\n.edit.content = <<END0\nhalf")
+	_ = fh.Close()
+
+	j, err = OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if entries := j.Entries(); len(entries) != 1 || string(entries[0].Content) != "one\n" {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestJournal_RejectsCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "session.edits.hjl")
+	j, err := OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestFile(t, dir, "a.txt", "one\n")
+	if err := j.Snapshot("call-1", "edit_file", path); err != nil {
+		t.Fatal(err)
+	}
+	_ = j.Close()
+
+	data, err := os.ReadFile(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte("{not json\n"), data...)
+	if err := os.WriteFile(journalPath, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenJournal(journalPath); err == nil {
+		t.Fatal("expected an error for a corrupt record")
+	}
+	if after, _ := os.ReadFile(journalPath); string(after) != string(corrupt) {
+		t.Errorf("journal was modified: %q", after)
+	}
+}
+
+func TestJournal_RequiresCallID(t *testing.T) {
+	dir := t.TempDir()
+	j, err := OpenJournal(filepath.Join(dir, "session.edits.hjl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	path := writeTestFile(t, dir, "a.txt", "v1\n")
+
+	result := callToolWithID(t, WithJournal(context.Background(), j), FindReplaceTool, "", findReplaceArgs{Path: path, OldText: "v1", NewText: "v2"})
+	if !strings.HasPrefix(result, "error: recording undo journal: tool call has no ID") {
+		t.Errorf("expected an error, got: %s", result)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "v1\n" {
+		t.Errorf("file was modified: %q", data)
+	}
+}
+
+// --- file tracker tests ---
+
+// modifyExternally rewrites path as another program would, moving its
+// mtime so the change is visible however coarse the filesystem's clock.
+func modifyExternally(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileTracker_EditRefusedAfterExternalChange(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "a.txt", "one\ntwo\nthree\n")
+	ft := NewFileTracker()
+
+	callToolWithContext(t, WithFileTracker(context.Background(), ft), ReadFileTool, readFileArgs{Path: path})
+	modifyExternally(t, path, "one\nTWO\nthree\n")
+
+	args := editFileArgs{Path: path, Operation: "replace", Start: "1:" + getHash(t, "one"), Content: "uno"}
+	result := callToolWithContext(t, WithFileTracker(context.Background(), ft), EditFileTool, args)
+	if !strings.HasPrefix(result, "error: "+path+" changed on disk since you last read it:\n") {
+		t.Fatalf("expected refusal, got: %s", result)
+	}
+	if !strings.Contains(result, "-two\n+TWO\n") {
+		t.Errorf("expected the changed lines, got: %s", result)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "one\nTWO\nthree\n" {
+		t.Errorf("file was modified: %q", data)
+	}
+
+	// the model has now seen the change, so trying again goes through.
+	result = callToolWithContext(t, WithFileTracker(context.Background(), ft), EditFileTool, args)
+	if !strings.HasPrefix(result, "ok:") || strings.Contains(result, "warning:") {
+		t.Fatalf("expected a clean edit, got: %s", result)
+	}
+
+	// nor does the tool's own write count as an external change.
+	args = editFileArgs{Path: path, Operation: "replace", Start: "3:" + getHash(t, "three"), Content: "tres"}
+	if result := callToolWithContext(t, WithFileTracker(context.Background(), ft), EditFileTool, args); !strings.HasPrefix(result, "ok:") || strings.Contains(result, "warning:") {
+		t.Fatalf("expected a clean edit, got: %s", result)
+	}
+}
+
+func TestFileTracker_FindReplaceRefusedAfterExternalChange(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "a.txt", "alpha\nbeta\n")
+	ft := NewFileTracker()
+	ctx := WithFileTracker(context.Background(), ft)
+
+	callToolWithContext(t, ctx, GrepFileTool, grepFileArgs{Path: path, Query: "beta"})
+	modifyExternally(t, path, "alpha\nbeta\ngamma\n")
+
+	args := findReplaceArgs{Path: path, OldText: "alpha", NewText: "ALPHA"}
+	result := callToolWithContext(t, ctx, FindReplaceTool, args)
+	if !strings.HasPrefix(result, "error: "+path+" changed on disk since you last read it:\n") || !strings.Contains(result, "+gamma\n") {
+		t.Fatalf("expected a refusal with the changed lines, got: %s", result)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "alpha\nbeta\ngamma\n" {
+		t.Errorf("expected the file to be left alone, got: %q", data)
+	}
+
+	// having been shown the change, the model can go ahead.
+	if result := callToolWithContext(t, ctx, FindReplaceTool, args); !strings.HasPrefix(result, "ok:") {
+		t.Errorf("expected the retry to succeed, got: %s", result)
+	}
+}
+
+func TestFileTracker_ReplaceAllDryRunKeepsWarning(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "a.txt", "alpha\nbeta\n")
+	ft := NewFileTracker()
+	ctx := WithFileTracker(context.Background(), ft)
+
+	callToolWithContext(t, ctx, ReadFileTool, readFileArgs{Path: path})
+	modifyExternally(t, path, "alpha\nbeta\ngamma\n")
+
+	args := replaceAllArgs{Paths: []string{path}, Pattern: "alpha", Replacement: "ALPHA", DryRun: true}
+	warning := "warning: " + path + " changed on disk since you last read it"
+	if result := callToolWithContext(t, ctx, ReplaceAllTool, args); !strings.Contains(result, warning) {
+		t.Errorf("expected the dry run to warn, got: %s", result)
+	}
+	args.DryRun = false
+	if result := callToolWithContext(t, ctx, ReplaceAllTool, args); !strings.HasPrefix(result, "ok:") || !strings.Contains(result, warning) {
+		t.Errorf("expected the real run to warn too, got: %s", result)
+	}
+}
+
+func TestFileTracker_UnreadAndDeleted(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "a.txt", "alpha\n")
+	ft := NewFileTracker()
+
+	result := callToolWithContext(t, WithFileTracker(context.Background(), ft), FindReplaceTool, findReplaceArgs{Path: path, OldText: "alpha", NewText: "beta"})
+	if !strings.Contains(result, "note: you haven't read "+path+" in this session\n") {
+		t.Errorf("expected an unread note, got: %s", result)
+	}
+
+	os.Remove(path)
+	result = callToolWithContext(t, WithFileTracker(context.Background(), ft), CreateFileTool, createFileArgs{Path: path, Content: "gamma\n"})
+	if !strings.HasPrefix(result, "ok:") || !strings.Contains(result, "warning: "+path+" was deleted since you last read it\n") {
+		t.Errorf("expected a deletion warning, got: %s", result)
+	}
+}
+
+func TestFileTracker_IgnoresTouch(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "a.txt", "one\ntwo\n")
+	ft := NewFileTracker()
+
+	callToolWithContext(t, WithFileTracker(context.Background(), ft), ReadFileTool, readFileArgs{Path: path})
+	modifyExternally(t, path, "one\ntwo\n")
+
+	args := editFileArgs{Path: path, Operation: "replace", Start: "2:" + getHash(t, "two"), Content: "three"}
+	if result := callToolWithContext(t, WithFileTracker(context.Background(), ft), EditFileTool, args); !strings.HasPrefix(result, "ok:") || strings.Contains(result, "warning:") {
+		t.Fatalf("expected a clean edit, got: %s", result)
+	}
+}
+
+func TestFileTracker_LargeFile(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("filler line\n", readFileStreamSize/12+1)
+	path := writeTestFile(t, dir, "big.log", content)
+	ft := NewFileTracker()
+
+	callToolWithContext(t, WithFileTracker(context.Background(), ft), ReadFileTool, readFileArgs{Path: path})
+	if change := ft.check(path, true); change.changed() || change.unread {
+		t.Fatalf("expected the streamed read to be recorded, got %+v", change)
+	}
+	modifyExternally(t, path, "changed\n"+content)
+	if change := ft.check(path, true); change.diff != "(the file is too large to show which lines changed)\n" {
+		t.Errorf("expected a too-large note, got %+v", change)
+	}
+}
@@ -18,15 +18,19 @@ type treeArgs struct {
 	ShowHidden bool   `json:"show_hidden,omitempty" json-description:"If true, include hidden files/directories (names starting with dot). Defaults to false."`
 	Offset     int    `json:"offset,omitempty" json-description:"1-indexed line number to start from (default 1)"`
 	Limit      int    `json:"limit,omitempty" json-description:"Maximum number of lines to return (default 200, max 500)"`
+
+	IncludeIgnored bool `json:"include_ignored,omitempty" json-description:"If true, descend into and list entries excluded by .gitignore or .ajentignore instead of summarizing them. Defaults to false."`
 }
 
 type treeEntry struct {
 	name  string
 	isDir bool
+	// descend is false for directories summarized rather than listed.
+	descend bool
 }
 
 var TreeTool = tools.NewTool("tree",
-	tools.WithDescription("Display a directory tree structure. Directories are listed before files at each level. Use offset and limit to paginate (default 200 lines, max 500)."),
+	tools.WithDescription("Display a directory tree structure. Directories are listed before files at each level. Directories excluded by .gitignore or .ajentignore are collapsed into a summary line with their entry count, and excluded files into a count per directory. Use offset and limit to paginate (default 200 lines, max 500)."),
 	tools.WithArgSchema(treeArgs{}),
 	tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
 		var params treeArgs
@@ -59,7 +63,11 @@ var TreeTool = tools.NewTool("tree",
 
 		var lines []string
 		lines = append(lines, ".")
-		buildTree(&lines, params.Path, "", params.Depth, params.ShowHidden)
+		var ignore *ignoreMatcher
+		if !params.IncludeIgnored {
+			ignore = newIgnoreMatcher(params.Path)
+		}
+		buildTree(&lines, params.Path, "", params.Depth, params.ShowHidden, ignore)
 
 		totalLines := len(lines)
 
@@ -83,7 +91,7 @@ var TreeTool = tools.NewTool("tree",
 	}),
 )
 
-func buildTree(lines *[]string, dir, prefix string, depth int, showHidden bool) {
+func buildTree(lines *[]string, dir, prefix string, depth int, showHidden bool, ignore *ignoreMatcher) {
 	if depth <= 0 {
 		return
 	}
@@ -92,15 +100,28 @@ func buildTree(lines *[]string, dir, prefix string, depth int, showHidden bool)
 	if err != nil {
 		return
 	}
+	if ignore != nil {
+		ignore.loadDir(dir)
+	}
 
 	// Filter and sort: directories first, then files, alphabetical within each group
 	var filtered []treeEntry
+	ignoredFiles := 0
 	for _, e := range entries {
 		name := e.Name()
 		if !showHidden && strings.HasPrefix(name, ".") {
 			continue
 		}
-		filtered = append(filtered, treeEntry{name: name, isDir: e.IsDir()})
+		path := filepath.Join(dir, name)
+		if ignore != nil && (e.IsDir() && name == ".git" || ignore.ignored(path, e.IsDir())) {
+			if e.IsDir() {
+				filtered = append(filtered, treeEntry{name: ignoredDirSummary(name, path), isDir: true})
+			} else {
+				ignoredFiles++
+			}
+			continue
+		}
+		filtered = append(filtered, treeEntry{name: name, isDir: e.IsDir(), descend: e.IsDir()})
 	}
 	sort.Slice(filtered, func(i, j int) bool {
 		if filtered[i].isDir != filtered[j].isDir {
@@ -108,6 +129,9 @@ func buildTree(lines *[]string, dir, prefix string, depth int, showHidden bool)
 		}
 		return filtered[i].name < filtered[j].name
 	})
+	if ignoredFiles > 0 {
+		filtered = append(filtered, treeEntry{name: ignoredFilesSummary(ignoredFiles)})
+	}
 
 	for i, entry := range filtered {
 		isLast := i == len(filtered)-1
@@ -120,8 +144,8 @@ func buildTree(lines *[]string, dir, prefix string, depth int, showHidden bool)
 
 		*lines = append(*lines, prefix+connector+entry.name)
 
-		if entry.isDir {
-			buildTree(lines, filepath.Join(dir, entry.name), prefix+childPrefix, depth-1, showHidden)
+		if entry.descend {
+			buildTree(lines, filepath.Join(dir, entry.name), prefix+childPrefix, depth-1, showHidden, ignore)
 		}
 	}
 }
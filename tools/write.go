@@ -0,0 +1,96 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// symlinkPolicy says what writeFileAtomic does when asked to write to a
+// symlink.
+type symlinkPolicy int
+
+const (
+	// followSymlinks writes to the file the link points to, leaving the
+	// link itself in place.
+	followSymlinks symlinkPolicy = iota
+	// refuseSymlinks fails rather than writing through a link.
+	refuseSymlinks
+)
+
+// writeFileAtomic replaces the contents of path with data, so that a crash
+// leaves either the old or the new contents but never a partial file. It
+// writes a temp file in the same directory, syncs it and renames it into
+// place. If path exists, its mode and (where possible) ownership are kept;
+// otherwise the file is created with perm.
+func writeFileAtomic(path string, data []byte, perm fs.FileMode, symlinks symlinkPolicy) (err error) {
+	target := path
+	if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		if symlinks == refuseSymlinks {
+			return fmt.Errorf("%s is a symlink", path)
+		}
+		if target, err = filepath.EvalSymlinks(path); err != nil {
+			return err
+		}
+	}
+
+	existing, err := os.Stat(target)
+	switch {
+	case err == nil:
+		if !existing.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		perm = existing.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	case errors.Is(err, fs.ErrNotExist):
+		existing = nil
+	default:
+		return err
+	}
+
+	dir := filepath.Dir(target)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(target)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if existing != nil {
+		// best effort: only root can give a file away, and a file we could
+		// write but not chown is still better edited than not.
+		preserveOwner(tmp, existing)
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir flushes a directory entry change, such as a rename, to disk. Not
+// every platform supports it, so errors are ignored.
+func syncDir(dir string) {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = fh.Sync()
+	_ = fh.Close()
+}
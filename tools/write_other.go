@@ -0,0 +1,10 @@
+//go:build !unix
+
+package tools
+
+import (
+	"io/fs"
+	"os"
+)
+
+func preserveOwner(fh *os.File, info fs.FileInfo) {}
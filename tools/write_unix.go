@@ -0,0 +1,16 @@
+//go:build unix
+
+package tools
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// preserveOwner gives fh the owner and group of info, ignoring failures.
+func preserveOwner(fh *os.File, info fs.FileInfo) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		_ = fh.Chown(int(st.Uid), int(st.Gid))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/models/gen"
+)
+
+// UsageEvent records the tokens used by a single model request. bellman's
+// response metadata doesn't report prompt cache reads and writes, so they
+// aren't tracked, and costs are only estimates for providers that bill
+// them separately.
+type UsageEvent struct {
+	Model          string `json:"model"`
+	InputTokens    int    `json:"input_tokens,omitempty"`
+	OutputTokens   int    `json:"output_tokens,omitempty"`
+	ThinkingTokens int    `json:"thinking_tokens,omitempty"`
+}
+
+func (u *UsageEvent) add(o UsageEvent) {
+	u.InputTokens += o.InputTokens
+	u.OutputTokens += o.OutputTokens
+	u.ThinkingTokens += o.ThinkingTokens
+}
+
+// modelPrice is a model's price in dollars per million tokens.
+type modelPrice struct {
+	Input, Output float64
+}
+
+// modelPrices maps model name prefixes to their prices. The longest
+// matching prefix wins, so dated model versions (e.g.
+// claude-haiku-4-5-20251001) find their base model's price.
+var modelPrices = map[string]modelPrice{
+	"claude-haiku-4-5":      {Input: 1, Output: 5},
+	"claude-sonnet-4":       {Input: 3, Output: 15},
+	"claude-opus-4":         {Input: 15, Output: 75},
+	"claude-opus-4-5":       {Input: 5, Output: 25},
+	"gpt-5":                 {Input: 1.25, Output: 10},
+	"gpt-5-mini":            {Input: 0.25, Output: 2},
+	"gpt-5-nano":            {Input: 0.05, Output: 0.40},
+	"gemini-2.5-pro":        {Input: 1.25, Output: 10},
+	"gemini-2.5-flash":      {Input: 0.30, Output: 2.50},
+	"gemini-2.5-flash-lite": {Input: 0.10, Output: 0.40},
+}
+
+// priceFor returns the price of the given model, if known.
+func priceFor(model string) (price modelPrice, ok bool) {
+	best := ""
+	for prefix, p := range modelPrices {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(best) {
+			best, price, ok = prefix, p, true
+		}
+	}
+	return price, ok
+}
+
+// cost returns the dollar cost of u, and whether the model's price is known.
+// Thinking tokens are billed as output tokens.
+func (u UsageEvent) cost() (float64, bool) {
+	p, ok := priceFor(u.Model)
+	if !ok {
+		return 0, false
+	}
+	return (float64(u.InputTokens)*p.Input +
+		float64(u.OutputTokens+u.ThinkingTokens)*p.Output) / 1e6, true
+}
+
+// usageFromMetadata converts provider response metadata for a request to
+// model into a UsageEvent. Providers report either the bare model name or,
+// outside of streaming, one qualified with the provider (e.g.
+// "Anthropic/claude-haiku-4-5"); the qualifier is dropped so that both
+// price and total the same.
+func usageFromMetadata(model gen.Model, md models.Metadata) UsageEvent {
+	name := model.Name
+	if md.Model != "" {
+		name = strings.TrimPrefix(md.Model, model.Provider+"/")
+	}
+	return UsageEvent{
+		Model:          name,
+		InputTokens:    md.InputTokens,
+		OutputTokens:   md.OutputTokens,
+		ThinkingTokens: md.ThinkingTokens,
+	}
+}
+
+// usageTotals accumulates usage per model over a session.
+type usageTotals map[string]*UsageEvent
+
+func (t usageTotals) add(u UsageEvent) {
+	total, ok := t[u.Model]
+	if !ok {
+		total = &UsageEvent{Model: u.Model}
+		t[u.Model] = total
+	}
+	total.add(u)
+}
+
+// String summarizes the totals across all models, with the dollar cost if
+// every model's price is known.
+func (t usageTotals) String() string {
+	var sum UsageEvent
+	var cost float64
+	costKnown := true
+	var unpriced []string
+	for model, u := range t {
+		sum.add(*u)
+		c, ok := u.cost()
+		if !ok {
+			costKnown = false
+			unpriced = append(unpriced, model)
+		}
+		cost += c
+	}
+	rv := fmt.Sprintf("session: %d in, %d out", sum.InputTokens, sum.OutputTokens+sum.ThinkingTokens)
+	if costKnown {
+		rv += fmt.Sprintf(", $%.4f", cost)
+	} else {
+		sort.Strings(unpriced)
+		rv += fmt.Sprintf(", $%.4f + unknown cost for %s", cost, strings.Join(unpriced, ", "))
+	}
+	return rv
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/models/gen"
+)
+
+func TestPriceFor_LongestPrefix(t *testing.T) {
+	p, ok := priceFor("claude-opus-4-5-20251101")
+	if !ok || p != modelPrices["claude-opus-4-5"] {
+		t.Errorf("expected claude-opus-4-5 price, got %+v (%v)", p, ok)
+	}
+	if _, ok := priceFor("some-local-model"); ok {
+		t.Error("expected no price for unknown model")
+	}
+}
+
+func TestSessionRun_UsageTotalsRestored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.hjl")
+	metadata := func(in, out int) *gen.StreamResponse {
+		return &gen.StreamResponse{Type: gen.TYPE_METADATA,
+			Metadata: &models.Metadata{InputTokens: in, OutputTokens: out}}
+	}
+	client := &fakeGen{turns: [][]*gen.StreamResponse{
+		{textDelta(0, "one"), metadata(1000, 200)},
+		{textDelta(0, "two"), metadata(3000, 400)},
+	}}
+
+	var out bytes.Buffer
+	session, err := NewSession(client, "claude-haiku-4-5", strings.NewReader("a\nb\n"), &out,
+		Config{Serializer: NewFileSerializer(path)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	_ = session.Close()
+	if !strings.Contains(out.String(), "[tokens: 3000 in, 400 out; session: 4000 in, 600 out, $0.0070]") {
+		t.Errorf("expected running totals in output, got %q", out.String())
+	}
+
+	session, err = NewSession(&fakeGen{}, "claude-haiku-4-5", strings.NewReader(""), &bytes.Buffer{},
+		Config{Serializer: NewFileSerializer(path)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	total := session.usage["claude-haiku-4-5"]
+	if total == nil || total.InputTokens != 4000 || total.OutputTokens != 600 {
+		t.Fatalf("unexpected restored totals: %+v", total)
+	}
+	if cost, _ := total.cost(); math.Abs(cost-0.007) > 1e-9 {
+		t.Errorf("expected $0.007, got $%v", cost)
+	}
+}
+
+func TestSessionRun_UsageProviderQualifiedModel(t *testing.T) {
+	metadata := func(model string, in, out int) *gen.StreamResponse {
+		return &gen.StreamResponse{Type: gen.TYPE_METADATA,
+			Metadata: &models.Metadata{Model: model, InputTokens: in, OutputTokens: out}}
+	}
+	client := &fakeGen{turns: [][]*gen.StreamResponse{
+		{textDelta(0, "one"), metadata("fake/claude-haiku-4-5", 1000, 200)},
+		{textDelta(0, "two"), metadata("claude-haiku-4-5", 3000, 400)},
+	}}
+
+	var out bytes.Buffer
+	session, err := NewSession(client, "claude-haiku-4-5", strings.NewReader("a\nb\n"), &out, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if len(session.usage) != 1 || session.usage["claude-haiku-4-5"] == nil {
+		t.Fatalf("expected totals under the bare model name, got %v", session.usage)
+	}
+	if !strings.Contains(out.String(), "session: 4000 in, 600 out, $0.0070]") {
+		t.Errorf("expected a priced total, got %q", out.String())
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -35,3 +36,9 @@ func defaultSessionPath() (string, error) {
 	name := fmt.Sprintf("%s-%s-%s.hjl", base, ts, hash)
 	return filepath.Join(dir, name), nil
 }
+
+// journalPath returns the path of the file edit journal kept next to the
+// session file at sessionPath.
+func journalPath(sessionPath string) string {
+	return strings.TrimSuffix(sessionPath, ".hjl") + ".edits.hjl"
+}